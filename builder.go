@@ -0,0 +1,78 @@
+package goosh
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoDevices is returned by NewMultiplexedRequest and NewBatchedRequest
+// when they're given no devices.
+var ErrNoDevices = errors.New("request has no devices")
+
+// RequestOption configures a Request built by NewMultiplexedRequest or
+// NewBatchedRequest.
+type RequestOption func(*Request)
+
+// WithAPNS sends the request through APNS with the given credentials.
+func WithAPNS(auth APNSAuth) RequestOption {
+	return func(r *Request) {
+		r.APNSAuth = &auth
+	}
+}
+
+// WithFCM sends the request through FCM with the given credentials.
+func WithFCM(auth FCMAuth) RequestOption {
+	return func(r *Request) {
+		r.FCMAuth = &auth
+	}
+}
+
+// WithCustomID sets the CustomID echoed back in the Response.
+func WithCustomID(id string) RequestOption {
+	return func(r *Request) {
+		r.CustomID = id
+	}
+}
+
+// NewMultiplexedRequest builds a request sending payload to every device.
+func NewMultiplexedRequest(pushID string, payload json.RawMessage, devices []string, options ...RequestOption) (*Request, error) {
+	if len(devices) == 0 {
+		return nil, ErrNoDevices
+	}
+	for _, d := range devices {
+		if d == "" {
+			return nil, errors.New("request has an empty device token")
+		}
+	}
+	r := &Request{
+		PushID:      pushID,
+		Multiplexed: &Multiplexed{Devices: devices, Payload: payload},
+	}
+	for _, f := range options {
+		f(r)
+	}
+	return r, nil
+}
+
+// NewBatchedRequest builds a request sending each device its own payload.
+func NewBatchedRequest(pushID string, perDevice map[string]json.RawMessage, options ...RequestOption) (*Request, error) {
+	if len(perDevice) == 0 {
+		return nil, ErrNoDevices
+	}
+	batched := Batched{}
+	for d, p := range perDevice {
+		if d == "" {
+			return nil, errors.New("request has an empty device token")
+		}
+		batched[d] = p
+	}
+	r := &Request{
+		PushID:  pushID,
+		Batched: &batched,
+	}
+	for _, f := range options {
+		f(r)
+	}
+	return r, nil
+}
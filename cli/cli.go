@@ -1,12 +1,14 @@
 package cli
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"git.sr.ht/~mmf/queuer"
@@ -18,6 +20,25 @@ var (
 	ErrQueueNotAvailable = errors.New("Queue isn't set on the client")
 )
 
+// defaultTimeout bounds every call to goosh, see WithTimeout to change it.
+const defaultTimeout = 60 * time.Second
+
+// MalformedMessageError is returned by Pop, and passed to the OnMalformed
+// handler by the Start loop, when a message on the out queue can't be
+// unmarshaled into a goosh.Response. Body holds the raw message.
+type MalformedMessageError struct {
+	Body []byte
+	Err  error
+}
+
+func (e *MalformedMessageError) Error() string {
+	return "malformed queue message: " + e.Err.Error()
+}
+
+func (e *MalformedMessageError) Cause() error {
+	return e.Err
+}
+
 type Client struct {
 	http      *http.Client
 	host      string
@@ -27,10 +48,22 @@ type Client struct {
 	outQueue  queuer.Queue
 	quit      chan bool
 	done      chan bool
+	started   bool
+	startLock sync.Mutex
+	quitOnce  sync.Once
 	responses chan *goosh.Response
+	malformed func(*MalformedMessageError)
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	// tlsConfig and timeout are applied to http once the options are.
+	tlsConfig *tls.Config
+	timeout   *time.Duration
 }
 
-func NewClient(protocol, host, port string) *Client {
+func NewClient(protocol, host, port string, options ...ClientOption) *Client {
 	if host == "" {
 		host = "localhost"
 	}
@@ -47,16 +80,41 @@ func NewClient(protocol, host, port string) *Client {
 		host:     host,
 		port:     port,
 		protocol: protocol,
+
+		maxAttempts:    defaultMaxAttempts,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
 	}
 
-	tr := &http.Transport{
-		MaxIdleConnsPerHost: 1024,
-		TLSHandshakeTimeout: 0 * time.Second,
+	for _, f := range options {
+		f(c)
 	}
+	if c.http == nil {
+		tr := &http.Transport{
+			MaxIdleConnsPerHost: 1024,
+			TLSHandshakeTimeout: 0 * time.Second,
+		}
 
-	c.http = &http.Client{
-		Transport: tr,
+		c.http = &http.Client{
+			Transport: tr,
+			Timeout:   defaultTimeout,
+		}
+	}
+	if c.timeout != nil {
+		c.http.Timeout = *c.timeout
 	}
+	if c.tlsConfig != nil {
+		rt := c.http.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		if tr, ok := rt.(*http.Transport); ok {
+			tr = tr.Clone()
+			tr.TLSClientConfig = c.tlsConfig
+			c.http.Transport = tr
+		}
+	}
+	c.quit = make(chan bool)
 	c.done = make(chan bool)
 	return c
 }
@@ -66,70 +124,69 @@ func (c *Client) SetQueues(q, out queuer.Queue) {
 	c.outQueue = out
 }
 
+// OnMalformed sets a handler called by the Start loop for every out queue
+// message it can't unmarshal. The loop skips those messages either way.
+func (c *Client) OnMalformed(f func(*MalformedMessageError)) {
+	c.malformed = f
+}
+
 func (c *Client) HTTP() *http.Client {
 	return c.http
 }
 
 func (c *Client) DoAsync(gr goosh.Request, callback string) error {
-	body, err := json.Marshal(gr)
+	return c.DoAsyncContext(context.Background(), gr, callback)
+}
 
-	if err != nil {
-		err = errors.Wrap(err, "Couldn't marshal body")
+// DoAsyncContext is DoAsync giving up as soon as ctx is done.
+func (c *Client) DoAsyncContext(ctx context.Context, gr goosh.Request, callback string) error {
+	if err := gr.Validate(); err != nil {
 		return err
 	}
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s:%s/push?callback=%s", c.protocol, c.host, c.port, callback), ioutil.NopCloser(bytes.NewBuffer(body)))
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
+	body, err := json.Marshal(gr)
 
 	if err != nil {
-		err = errors.Wrap(err, "Couldn't build request")
+		err = errors.Wrap(err, "Couldn't marshal body")
 		return err
 	}
 
-	res, err := c.http.Do(req)
+	res, err := c.post(ctx, fmt.Sprintf("%s://%s:%s/push?callback=%s", c.protocol, c.host, c.port, callback), body)
 
 	if err != nil {
-		err = errors.Wrap(err, "Couldn't call goosh")
 		return err
 	}
 
 	if res.StatusCode >= 300 {
-		err = errors.New(fmt.Sprintf("Something went wrong while calling goosh [%d]", res.StatusCode))
-		return err
+		return statusError(res)
 	}
+	res.Body.Close()
 	return nil
 }
 
 func (c *Client) Do(gr goosh.Request) (*goosh.Response, error) {
-	body, err := json.Marshal(gr)
+	return c.DoContext(context.Background(), gr)
+}
 
-	if err != nil {
-		err = errors.Wrap(err, "Couldn't marshal body")
+// DoContext is Do giving up as soon as ctx is done.
+func (c *Client) DoContext(ctx context.Context, gr goosh.Request) (*goosh.Response, error) {
+	if err := gr.Validate(); err != nil {
 		return nil, err
 	}
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s:%s/push", c.protocol, c.host, c.port), ioutil.NopCloser(bytes.NewBuffer(body)))
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
+	body, err := json.Marshal(gr)
 
 	if err != nil {
-		err = errors.Wrap(err, "Couldn't build request")
+		err = errors.Wrap(err, "Couldn't marshal body")
 		return nil, err
 	}
 
-	res, err := c.http.Do(req)
+	res, err := c.post(ctx, fmt.Sprintf("%s://%s:%s/push", c.protocol, c.host, c.port), body)
 
 	if err != nil {
-		err = errors.Wrap(err, "Couldn't call goosh")
 		return nil, err
 	}
 
 	if res.StatusCode >= 300 {
-		err = errors.New(fmt.Sprintf("Something went wrong while calling goosh [%d]", res.StatusCode))
-		return nil, err
+		return nil, statusError(res)
 	}
 
 	defer res.Body.Close()
@@ -148,10 +205,27 @@ func (c *Client) Do(gr goosh.Request) (*goosh.Response, error) {
 	return &gresp, nil
 }
 
+// statusError describes a failed call to goosh, using the Error of the
+// response body when there's one.
+func statusError(res *http.Response) error {
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err == nil {
+		var gresp goosh.Response
+		if json.Unmarshal(body, &gresp) == nil && gresp.Error != nil {
+			return errors.New(fmt.Sprintf("Something went wrong while calling goosh [%d]: %s", res.StatusCode, gresp.Error.Description))
+		}
+	}
+	return errors.New(fmt.Sprintf("Something went wrong while calling goosh [%d]", res.StatusCode))
+}
+
 func (c *Client) Enqueue(gr *goosh.Request) error {
 	if c.queue == nil {
 		return ErrQueueNotAvailable
 	}
+	if err := gr.Validate(); err != nil {
+		return err
+	}
 	bts, err := json.Marshal(gr)
 
 	if err != nil {
@@ -178,18 +252,26 @@ func (c *Client) Pop() (*goosh.Response, error) {
 	err := json.Unmarshal(obj.Body(), &gr)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "Goosh#Enqueue: couldn't unmarshal request")
+		return nil, &MalformedMessageError{Body: obj.Body(), Err: errors.Wrap(err, "Goosh#Pop: couldn't unmarshal response")}
 	}
 
 	return &gr, nil
 }
 
+// Start runs a loop receiving the responses of the out queue, see Receive.
+// Calling it again once started does nothing.
 func (c *Client) Start() error {
 	if c.outQueue == nil {
 		return ErrQueueNotAvailable
 	}
+	c.startLock.Lock()
+	defer c.startLock.Unlock()
+	if c.started {
+		return nil
+	}
 
 	c.responses = make(chan *goosh.Response)
+	c.started = true
 
 	go func() {
 		for {
@@ -203,21 +285,47 @@ func (c *Client) Start() error {
 
 				if err != nil {
 					log.Printf("Client#Start: couldn't unmarshal response: %+v", err)
+					if c.malformed != nil {
+						c.malformed(&MalformedMessageError{Body: obj.Body(), Err: err})
+					}
 					continue
 				}
 				gr.SetDone(obj.Done)
-				c.responses <- &gr
+				select {
+				case c.responses <- &gr:
+				case <-c.quit:
+					close(c.done)
+					return
+				}
 			}
 		}
 	}()
 	return nil
 }
 
+// Quit stops the Start loop, waiting for it to return. It can be called
+// more than once, and without Start.
 func (c *Client) Quit() {
-	close(c.quit)
-	<-c.done
+	c.quitOnce.Do(func() {
+		close(c.quit)
+	})
+	c.startLock.Lock()
+	started := c.started
+	c.startLock.Unlock()
+	if started {
+		<-c.done
+	}
+}
+
+// Close stops the Start loop and releases the idle connections to goosh.
+func (c *Client) Close() error {
+	c.Quit()
+	c.http.CloseIdleConnections()
+	return nil
 }
 
 func (c *Client) Receive() <-chan *goosh.Response {
+	c.startLock.Lock()
+	defer c.startLock.Unlock()
 	return c.responses
 }
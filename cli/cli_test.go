@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~mmf/queuer"
+)
+
+// chanQueue is a queuer.Queue receiving from a channel.
+type chanQueue chan queuer.Object
+
+func (q chanQueue) Start() chan queuer.Object                  { return q }
+func (q chanQueue) Publish([]byte) error                       { return nil }
+func (q chanQueue) PublishWithRoutingKey(string, []byte) error { return nil }
+func (q chanQueue) Receive() <-chan queuer.Object              { return q }
+func (q chanQueue) Stop()                                      {}
+
+func TestStartTwice(t *testing.T) {
+	c := NewClient("", "", "")
+	c.SetQueues(nil, make(chanQueue))
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Start(); err != nil {
+				t.Errorf("Start: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Receive() == nil {
+		t.Fatal("Receive is nil once started")
+	}
+	quit := make(chan bool)
+	go func() {
+		c.Quit()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Quit didn't return")
+	}
+}
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// ClientOption configures a Client built by NewClient.
+type ClientOption func(*Client)
+
+// WithHTTPClient has the Client call goosh through hc rather than its own
+// http.Client. hc is only copied, so WithTLSConfig and WithTimeout don't
+// change it.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		cp := *hc
+		c.http = &cp
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to reach goosh, to trust a
+// custom CA or present a client certificate. With WithHTTPClient, it only
+// applies when the client's Transport is an *http.Transport.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithTimeout bounds every call to goosh, replacing the 60 seconds default.
+// Zero means no timeout.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = &d
+	}
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+)
+
+// WithRetries has calls to goosh attempted up to attempts times when they
+// fail with a 502, 503 or 504 or can't reach the server. The wait between
+// attempts starts at initial and doubles up to max, unless the server sends
+// a Retry-After. One attempt fails fast.
+func WithRetries(attempts int, initial, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxAttempts = attempts
+		c.initialBackoff = initial
+		c.maxBackoff = max
+	}
+}
+
+// post sends body to url, retrying as configured by WithRetries. The
+// response is returned as is, whatever its status.
+func (c *Client) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	backoff := c.initialBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, ioutil.NopCloser(bytes.NewBuffer(body)))
+		if err != nil {
+			return nil, errors.Wrap(err, "Couldn't build request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+
+		res, err := c.http.Do(req)
+		last := attempt >= c.maxAttempts || ctx.Err() != nil
+		if err != nil {
+			if last {
+				return nil, errors.Wrap(err, "Couldn't call goosh")
+			}
+		} else if !retryableStatus(res.StatusCode) || last {
+			return res, nil
+		}
+		wait := backoff
+		if res != nil {
+			if after := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); after > 0 {
+				wait = after
+			}
+			res.Body.Close()
+		}
+		if c.maxBackoff > 0 && wait > c.maxBackoff {
+			wait = c.maxBackoff
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "Couldn't call goosh")
+		}
+		backoff *= 2
+	}
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as
+// an HTTP date, returning zero when it's missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
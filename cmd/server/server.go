@@ -6,59 +6,149 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/michele/factotum"
+	"git.sr.ht/~mmf/queuer"
+	"github.com/michele/goosh"
 	"github.com/michele/goosh/router"
-	"github.com/michele/goosh/services/apns2"
-	"github.com/michele/goosh/services/fcm"
+	"github.com/michele/goosh/services"
+	"github.com/michele/goosh/worker"
+	"github.com/pkg/errors"
 )
 
 func main() {
-	logger := log.New(os.Stdout, "", 0)
+	logger := goosh.NewLogger(log.New(os.Stdout, "", 0), goosh.ParseLevel(os.Getenv("GOOSH_LOG_LEVEL")))
 	wait := sync.WaitGroup{}
-	wait.Add(3)
+	wait.Add(2)
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
-	wg := factotum.NewWorkerGroup(100)
-	apns := apns2.NewPushService(wg.WorkQueue)
-	fcm := fcm.NewPushService(wg.WorkQueue)
-	cb := factotum.NewWorkerGroup(1)
-	wg.Start()
+	if err := services.EnvError(); err != nil {
+		logger.Error("Couldn't configure the push services", "error", err)
+		os.Exit(1)
+	}
+	d := services.NewDispatcher(100, logger)
+	cb := worker.NewWorkerGroup(1)
 	cb.Start()
 
-	s := router.NewServer(func(s *router.Server) { s.Logger = logger }, func(s *router.Server) { s.APNS = apns }, func(s *router.Server) { s.FCM = fcm }, func(s *router.Server) { s.CB = cb })
-
-	h := &http.Server{Addr: ":8080", Handler: s}
+	s := router.NewServer(func(s *router.Server) { s.Log = logger }, router.WithDispatcher(d), func(s *router.Server) { s.CB = cb })
+	s.AuthToken = os.Getenv("GOOSH_AUTH_TOKEN")
+	s.AuthSecret = os.Getenv("GOOSH_AUTH_SECRET")
+	s.CallbackSecret = os.Getenv("GOOSH_CALLBACK_SECRET")
+	if size, err := strconv.Atoi(os.Getenv("GOOSH_RESULTS_SIZE")); err == nil && size > 0 {
+		ttl, err := time.ParseDuration(os.Getenv("GOOSH_RESULTS_TTL"))
+		if err != nil {
+			ttl = time.Hour
+		}
+		s.Results = router.NewResultStore(size, ttl)
+	}
+	if attempts, err := strconv.Atoi(os.Getenv("GOOSH_ASYNC_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		s.AsyncMaxAttempts = attempts
+	}
+	if path := os.Getenv("GOOSH_RETRY_STORE"); len(path) > 0 {
+		s.RetryStore = router.FileRetryStore{Path: path}
+		if err := s.ResumeRetries(); err != nil {
+			logger.Error("Couldn't resume pending retries", "error", err)
+		}
+	}
 
-	go func() {
-		logger.Printf("Listening on http://0.0.0.0%s\n", ":8080")
+	addr := os.Getenv("GOOSH_LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	cert, key := os.Getenv("GOOSH_TLS_CERT"), os.Getenv("GOOSH_TLS_KEY")
+	if (cert == "") != (key == "") {
+		logger.Error("GOOSH_TLS_CERT and GOOSH_TLS_KEY must be set together")
+		os.Exit(1)
+	}
+	h := &http.Server{Addr: addr, Handler: s}
 
-		if err := h.ListenAndServe(); err != nil {
-			logger.Printf("HTTP server stopped: %+v", err)
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+	defer stopQueue()
+	queueDone := make(chan bool)
+	if name := os.Getenv("GOOSH_SQS_IN"); len(name) > 0 {
+		in, out, err := sqsQueues(name, os.Getenv("GOOSH_SQS_OUT"))
+		if err != nil {
+			logger.Error("Couldn't set up the SQS queues", "error", err)
+			os.Exit(1)
 		}
-		wait.Done()
-	}()
+		in.Start()
+		go func() {
+			logger.Info("Consuming queue", "queue", name)
+			s.ServeQueue(queueCtx, in, out)
+			in.Stop()
+			close(queueDone)
+		}()
+	} else {
+		close(queueDone)
+	}
 
-	<-sigint
-	logger.Println("\nShutting down the server...")
-	s.GoingAway = true
 	go func() {
-		wg.Stop()
+		var err error
+		if cert != "" {
+			logger.Info("Listening", "addr", "https://"+addr)
+			err = h.ListenAndServeTLS(cert, key)
+		} else {
+			logger.Info("Listening", "addr", "http://"+addr)
+			err = h.ListenAndServe()
+		}
+		if err != nil {
+			logger.Info("HTTP server stopped", "error", err)
+		}
 		wait.Done()
 	}()
 
-	go func() {
-		cb.Stop()
-		wait.Done()
-	}()
+	<-sigint
+	logger.Info("Shutting down the server")
+	s.SetGoingAway(true)
+	stopQueue()
 
-	ctx, _ := context.WithTimeout(context.Background(), 600*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
 
+	// Pushes are drained first since finishing them enqueues callbacks.
+	// Queued pushes still being processed need the workers too, and the
+	// requests and async attempts still running need them to queue their
+	// devices.
 	go func() {
-		h.Shutdown(ctx)
+		if err := h.Shutdown(ctx); err != nil {
+			logger.Warn("Gave up waiting for in-flight requests", "error", err)
+		}
+		<-queueDone
+		if err := s.WaitAsync(ctx); err != nil {
+			logger.Warn("Gave up waiting for async pushes", "error", err)
+		}
+		if err := d.Stop(ctx); err != nil {
+			logger.Warn("Gave up waiting for in-flight pushes", "error", err)
+		}
+		if err := s.FlushRetries(); err != nil {
+			logger.Error("Couldn't persist pending retries", "error", err)
+		}
+		if err := cb.StopContext(ctx); err != nil {
+			logger.Warn("Gave up waiting for pending callbacks", "error", err)
+		}
+		wait.Done()
 	}()
 	wait.Wait()
-	logger.Println("Bye bye...")
+	logger.Info("Bye bye")
+}
+
+// sqsQueues connects to the SQS queues requests are consumed from and
+// responses published to, using the usual AWS environment variables.
+func sqsQueues(in, out string) (*queuer.SQSQueue, *queuer.SQSQueue, error) {
+	akey, skey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	region, endpoint, env := os.Getenv("AWS_REGION"), os.Getenv("GOOSH_SQS_ENDPOINT"), os.Getenv("GOOSH_ENV")
+	if out == "" {
+		return nil, nil, errors.New("GOOSH_SQS_OUT is required with GOOSH_SQS_IN")
+	}
+	inQ, err := queuer.NewSQS(akey, skey, in, region, endpoint, env, false)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "couldn't connect to the request queue")
+	}
+	outQ, err := queuer.NewSQS(akey, skey, out, region, endpoint, env, true)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "couldn't connect to the response queue")
+	}
+	return inQ, outQ, nil
 }
@@ -0,0 +1,120 @@
+package goosh
+
+import (
+	"context"
+	"sync"
+
+	"github.com/michele/goosh/worker"
+	"github.com/pkg/errors"
+)
+
+// Dispatcher sends requests through the PushService of their platform,
+// without going through the HTTP server. The services package wires one up
+// with the APNS and FCM services.
+type Dispatcher struct {
+	APNS PushService
+	FCM  PushService
+	// Workers, when set, is the WorkerGroup the services enqueue to. Stop
+	// drains it.
+	Workers *worker.WorkerGroup
+	// Log receives the failures of the platforms of mixed requests, it
+	// defaults to DefaultLogger.
+	Log Logger
+}
+
+// NewDispatcher returns a Dispatcher sending through apns and fcm.
+func NewDispatcher(apns PushService, fcm PushService) *Dispatcher {
+	return &Dispatcher{APNS: apns, FCM: fcm, Log: DefaultLogger()}
+}
+
+// Send sends each platform's part of r through its service, concurrently
+// for mixed requests, and merges the results into a single response. It
+// only fails when every platform failed.
+func (d *Dispatcher) Send(ctx context.Context, r Request) (Response, error) {
+	return d.SendStream(ctx, r, nil)
+}
+
+// SendStream is Send sending the DeviceResponses to stream, rather than
+// collecting them, through the services that support it.
+func (d *Dispatcher) SendStream(ctx context.Context, r Request, stream chan<- DeviceResponse) (Response, error) {
+	dr, err := d.dispatch(ctx, r, stream)
+	dr.TraceID = r.TraceID
+	return dr, err
+}
+
+// Stop waits for the Workers to finish the pushes they were given, or for
+// ctx to be done.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	if d.Workers == nil {
+		return nil
+	}
+	return d.Workers.StopContext(ctx)
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, r Request, stream chan<- DeviceResponse) (Response, error) {
+	ctx, cancel := r.WithTimeout(ctx)
+	defer cancel()
+	apnsReq, fcmReq := r.Split()
+	if apnsReq == nil && fcmReq == nil {
+		return Response{PushID: r.PushID, CustomID: r.CustomID, Service: r.Platform()}, nil
+	}
+	if apnsReq != nil && d.APNS == nil {
+		return FailedResponse(r, ServiceAPNS, &Error{Code: 501, Description: "APNS isn't configured"}), errors.New("no APNS service")
+	}
+	if fcmReq != nil && d.FCM == nil {
+		return FailedResponse(r, ServiceFCM, &Error{Code: 501, Description: "FCM isn't configured"}), errors.New("no FCM service")
+	}
+	if fcmReq == nil {
+		return process(ctx, d.APNS, *apnsReq, stream)
+	}
+	if apnsReq == nil {
+		return process(ctx, d.FCM, *fcmReq, stream)
+	}
+	var wg sync.WaitGroup
+	var apnsRes, fcmRes Response
+	var apnsErr, fcmErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		apnsRes, apnsErr = process(ctx, d.APNS, *apnsReq, stream)
+	}()
+	go func() {
+		defer wg.Done()
+		fcmRes, fcmErr = process(ctx, d.FCM, *fcmReq, stream)
+	}()
+	wg.Wait()
+	dr := MergeResponses(apnsRes, fcmRes)
+	if apnsErr != nil && fcmErr != nil {
+		return dr, errors.Wrapf(apnsErr, "FCM failed too (%v)", fcmErr)
+	}
+	if apnsErr != nil {
+		d.log().Warn("Couldn't process APNS part of push", append(PushFields(*apnsReq), "error", apnsErr)...)
+	}
+	if fcmErr != nil {
+		d.log().Warn("Couldn't process FCM part of push", append(PushFields(*fcmReq), "error", fcmErr)...)
+	}
+	return dr, nil
+}
+
+func (d *Dispatcher) log() Logger {
+	if d.Log == nil {
+		return DefaultLogger()
+	}
+	return d.Log
+}
+
+func process(ctx context.Context, ps PushService, r Request, stream chan<- DeviceResponse) (Response, error) {
+	if sps, ok := ps.(StreamingPushService); ok && stream != nil {
+		return sps.ProcessStream(ctx, r, stream)
+	}
+	return ps.ProcessContext(ctx, r)
+}
+
+// PushFields describes a push in log entries.
+func PushFields(r Request) []interface{} {
+	fields := []interface{}{"push_id", r.PushID, "service", r.Platform(), "devices", r.Count()}
+	if r.TraceID != "" {
+		fields = append(fields, "trace_id", r.TraceID)
+	}
+	return fields
+}
@@ -0,0 +1,76 @@
+package goosh
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// PayloadFilter restricts which top-level keys of a push payload are
+// forwarded to the provider. When Allow is non-empty only those keys are
+// permitted; keys listed in Deny are never permitted. Disallowed keys cause
+// the push to be rejected unless Strip is set, in which case they're removed.
+type PayloadFilter struct {
+	Allow []string
+	Deny  []string
+	Strip bool
+}
+
+// DisallowedKeyError is returned by PayloadFilter.Apply when a payload
+// carries a key the filter rejects.
+type DisallowedKeyError struct {
+	Key string
+}
+
+func (e DisallowedKeyError) Error() string {
+	return "payload key not allowed: " + e.Key
+}
+
+func (f *PayloadFilter) allowed(key string) bool {
+	for _, k := range f.Deny {
+		if k == key {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, k := range f.Allow {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the payload with the filter applied. A nil filter returns the
+// payload untouched, as does a payload without disallowed keys.
+func (f *PayloadFilter) Apply(payload json.RawMessage) (json.RawMessage, error) {
+	if f == nil || (len(f.Allow) == 0 && len(f.Deny) == 0) {
+		return payload, nil
+	}
+	var parsed map[string]json.RawMessage
+	err := json.Unmarshal(payload, &parsed)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't unmarshal payload for filtering")
+	}
+	stripped := false
+	for k := range parsed {
+		if f.allowed(k) {
+			continue
+		}
+		if !f.Strip {
+			return nil, DisallowedKeyError{Key: k}
+		}
+		delete(parsed, k)
+		stripped = true
+	}
+	if !stripped {
+		return payload, nil
+	}
+	filtered, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't marshal filtered payload")
+	}
+	return filtered, nil
+}
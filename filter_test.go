@@ -0,0 +1,50 @@
+package goosh
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPayloadFilter(t *testing.T) {
+	payload := json.RawMessage(`{"aps":{"alert":"hi"},"secret":"x","extra":1}`)
+	tests := []struct {
+		name    string
+		filter  *PayloadFilter
+		want    string
+		wantKey string
+	}{
+		{"nil", nil, string(payload), ""},
+		{"empty", &PayloadFilter{Strip: true}, string(payload), ""},
+		{"allowed", &PayloadFilter{Allow: []string{"aps", "secret", "extra"}}, string(payload), ""},
+		{"strip denied", &PayloadFilter{Deny: []string{"secret"}, Strip: true}, `{"aps":{"alert":"hi"},"extra":1}`, ""},
+		{"strip not allowed", &PayloadFilter{Allow: []string{"aps"}, Strip: true}, `{"aps":{"alert":"hi"}}`, ""},
+		{"deny wins over allow", &PayloadFilter{Allow: []string{"aps", "secret", "extra"}, Deny: []string{"secret"}, Strip: true}, `{"aps":{"alert":"hi"},"extra":1}`, ""},
+		{"reject denied", &PayloadFilter{Deny: []string{"secret"}}, "", "secret"},
+		{"reject not allowed", &PayloadFilter{Allow: []string{"aps", "extra"}}, "", "secret"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.filter.Apply(payload)
+			if test.wantKey != "" {
+				dke, ok := err.(DisallowedKeyError)
+				if !ok || dke.Key != test.wantKey {
+					t.Fatalf("got error %v, want a DisallowedKeyError for %q", err, test.wantKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if string(got) != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPayloadFilterInvalidPayload(t *testing.T) {
+	f := &PayloadFilter{Deny: []string{"secret"}}
+	if _, err := f.Apply(json.RawMessage(`[1,2]`)); err == nil {
+		t.Fatal("a payload that isn't an object was accepted")
+	}
+}
@@ -6,8 +6,8 @@ require (
 	git.sr.ht/~mmf/queuer v0.2.0
 	github.com/aws/aws-sdk-go v1.25.48 // indirect
 	github.com/google/uuid v0.0.0-20161128191214-064e2069ce9c
-	github.com/michele/factotum v0.1.0
 	github.com/pkg/errors v0.8.1
-	golang.org/x/net v0.0.0-20191204025024-5ee1b9f4859a
-	golang.org/x/text v0.3.2
+	github.com/prometheus/client_golang v1.7.1
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
 )
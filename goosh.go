@@ -1,12 +1,29 @@
 package goosh
 
 import (
+	"context"
 	"encoding/json"
+	"sort"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type PushService interface {
 	Process(Request) (Response, error)
+	// ProcessContext is Process stopping as soon as ctx is done: devices
+	// that weren't sent by then are reported as canceled.
+	ProcessContext(context.Context, Request) (Response, error)
+}
+
+// StreamingPushService is a PushService able to hand out every
+// DeviceResponse as soon as it's known.
+type StreamingPushService interface {
+	PushService
+	// ProcessStream is ProcessContext sending the DeviceResponses to devices
+	// instead of collecting them in the Response, which only keeps the
+	// totals. devices isn't closed.
+	ProcessStream(ctx context.Context, r Request, devices chan<- DeviceResponse) (Response, error)
 }
 
 type Request struct {
@@ -16,6 +33,44 @@ type Request struct {
 	APNSAuth    *APNSAuth    `json:"apns,omitempty"`
 	FCMAuth     *FCMAuth     `json:"fcm,omitempty"`
 	CustomID    string       `json:"custom_id"`
+
+	// SplitSections tags every DeviceResponse with the section (multiplexed
+	// or batched) it came from and adds per-section totals to the Response.
+	SplitSections bool `json:"split_sections,omitempty"`
+
+	// APNSTargets and FCMTargets address devices of a single platform, so
+	// that one request can reach both. See Split.
+	APNSTargets *Targets `json:"apns_targets,omitempty"`
+	FCMTargets  *Targets `json:"fcm_targets,omitempty"`
+
+	// APNSIDs optionally maps device tokens to the apns-id (a UUID) their
+	// push is sent with, so that retries can be deduplicated by the caller.
+	APNSIDs map[string]string `json:"apns_ids,omitempty"`
+
+	// Broadcast, for FCM only, sends a single push to the subscribers of a
+	// topic or of a condition of topics.
+	Broadcast *Broadcast `json:"broadcast,omitempty"`
+
+	// DryRun has FCM validate the pushes without delivering them. APNS has
+	// no such mode and refuses dry runs.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// VerifyTokens checks which devices are still registered without
+	// showing anything to their users. APNS pushes are sent as silent
+	// background pushes, whatever their payload, and FCM pushes as dry
+	// runs. Dead tokens end up in Response.Unregistered.
+	VerifyTokens bool `json:"verify_tokens,omitempty"`
+
+	// TraceID correlates the push across services. The server takes it
+	// from the X-Request-Id header when there's one, logs it and echoes it
+	// in the Response and on callbacks.
+	TraceID string `json:"trace_id,omitempty"`
+
+	// Timeout, in seconds, is how long the whole request may take. Devices
+	// that weren't sent by then are reported as canceled and flagged for
+	// retry. Zero means no timeout.
+	Timeout int64 `json:"timeout,omitempty"`
+
 	iterator    int
 	batchedKeys []string
 	initialized bool
@@ -33,22 +88,104 @@ type Multiplexed struct {
 // Batched provides a payload for each device
 type Batched map[string]json.RawMessage
 
+// Broadcast targets FCM topic subscribers rather than devices. Exactly one
+// of Topic (a topic name) and Condition (like "'a' in topics && 'b' in
+// topics") must be set.
+type Broadcast struct {
+	Topic     string          `json:"topic,omitempty"`
+	Condition string          `json:"condition,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Kinds of broadcasts, see Message.Broadcast.
+const (
+	BroadcastTopic     = "topic"
+	BroadcastCondition = "condition"
+)
+
+// Targets are the devices of a Request on a single platform.
+type Targets struct {
+	Multiplexed *Multiplexed `json:"multiplexed,omitempty"`
+	Batched     *Batched     `json:"batched,omitempty"`
+}
+
+// Sections of a Request, used to attribute results when SplitSections is set.
+const (
+	SectionMultiplexed = "multiplexed"
+	SectionBatched     = "batched"
+	SectionBroadcast   = "broadcast"
+)
+
 func (r Request) Platform() string {
 	if r.FCMAuth != nil && r.APNSAuth == nil {
-		return "fcm"
+		return ServiceFCM
 	}
 	if r.FCMAuth == nil && r.APNSAuth != nil {
-		return "apns"
+		return ServiceAPNS
+	}
+	if r.FCMAuth != nil && r.APNSAuth != nil {
+		return ServiceMixed
 	}
 	return ""
 }
 
+// IsMixed tells whether the request carries credentials for both platforms.
+func (r Request) IsMixed() bool {
+	return r.Platform() == ServiceMixed
+}
+
+// Split returns the part of the request to send through each platform, nil
+// when there's no credentials or no devices for it. A platform's targets
+// are used when present; the top-level Multiplexed and Batched devices are
+// only used by single-platform requests. Broadcasts only go through FCM.
+func (r Request) Split() (apns *Request, fcm *Request) {
+	if r.APNSAuth != nil {
+		apns = r.platformRequest(r.APNSTargets)
+		apns.FCMAuth = nil
+		apns.Broadcast = nil
+	}
+	if r.FCMAuth != nil {
+		fcm = r.platformRequest(r.FCMTargets)
+		fcm.APNSAuth = nil
+	}
+	if apns != nil && apns.Count() == 0 {
+		apns = nil
+	}
+	if fcm != nil && fcm.Count() == 0 {
+		fcm = nil
+	}
+	return
+}
+
+func (r Request) platformRequest(t *Targets) *Request {
+	sub := r
+	sub.APNSTargets = nil
+	sub.FCMTargets = nil
+	if t != nil {
+		sub.Multiplexed = t.Multiplexed
+		sub.Batched = t.Batched
+	} else if r.IsMixed() {
+		sub.Multiplexed = nil
+		sub.Batched = nil
+	}
+	return &sub
+}
+
+// WithTimeout derives the context the request is processed in from ctx,
+// applying its Timeout.
+func (r Request) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(r.Timeout)*time.Second)
+}
+
 func (r Request) IsAPNS() bool {
-	return r.Platform() == "apns"
+	return r.Platform() == ServiceAPNS
 }
 
 func (r Request) IsFCM() bool {
-	return r.Platform() == "fcm"
+	return r.Platform() == ServiceFCM
 }
 
 func (r *Request) Reset() {
@@ -59,20 +196,20 @@ func (r *Request) initialize() {
 	if !r.initialized {
 		r.Reset()
 		r.initialized = true
-		r.batchedKeys = []string{}
-		if r.Batched != nil {
-			for k, _ := range *r.Batched {
-				r.batchedKeys = append(r.batchedKeys, k)
-			}
-		}
+		r.batchedKeys = r.sortedBatched()
 		if r.Multiplexed != nil {
 			r.total += len(r.Multiplexed.Devices)
 			r.multiLen = len(r.Multiplexed.Devices)
 		}
 		r.total += len(r.batchedKeys)
+		if r.Broadcast != nil {
+			r.total++
+		}
 	}
 }
 
+// Next advances to the next message of the request, in the order of
+// Messages, broadcast included.
 func (r *Request) Next() bool {
 	r.initialize()
 	r.iterator++
@@ -87,19 +224,176 @@ func (r *Request) Value() (msg Message) {
 		return
 	}
 	if r.iterator < r.multiLen {
-		msg.Payload = r.Multiplexed.Payload
-		msg.Token = r.Multiplexed.Devices[r.iterator]
-		return
+		return r.message(r.Multiplexed.Devices[r.iterator], r.Multiplexed.Payload, SectionMultiplexed)
 	}
 	offi := r.iterator - r.multiLen
-	msg.Token = r.batchedKeys[offi]
-	msg.Payload = (*r.Batched)[r.batchedKeys[offi]]
-	return
+	if offi == len(r.batchedKeys) {
+		return r.broadcastMessage()
+	}
+	return r.message(r.batchedKeys[offi], (*r.Batched)[r.batchedKeys[offi]], SectionBatched)
+}
+
+func (r *Request) message(token string, payload json.RawMessage, section string) Message {
+	msg := Message{Token: token, Payload: payload, DryRun: r.DryRun}
+	if r.VerifyTokens && r.FCMAuth != nil {
+		msg.DryRun = true
+	}
+	if r.SplitSections {
+		msg.Section = section
+	}
+	if r.FCMAuth != nil {
+		msg.TimeToLive = r.FCMAuth.TimeToLive
+		msg.FCMPriority = r.FCMAuth.Priority
+	}
+	if r.APNSAuth != nil {
+		msg.PushType = r.APNSAuth.PushType
+		msg.Priority = r.APNSAuth.Priority
+		msg.Topic = r.APNSAuth.Topic
+		msg.CollapseID = r.APNSAuth.CollapseID
+		msg.APNSID = r.APNSIDs[token]
+		if r.APNSAuth.Expiration != nil {
+			msg.Expiration = *r.APNSAuth.Expiration
+		}
+		if r.VerifyTokens {
+			msg.Payload = verifyPayload
+			msg.PushType = "background"
+			msg.Priority = 5
+			msg.CollapseID = ""
+		}
+	}
+	return msg
+}
+
+// verifyPayload is the silent push sent to APNS devices by VerifyTokens
+// requests.
+var verifyPayload = json.RawMessage(`{"aps":{"content-available":1}}`)
+
+// Messages returns a closed channel holding every message of the request,
+// multiplexed devices first. It doesn't touch the Next/Value iterator, so
+// several goroutines can each range over their own channel.
+func (r *Request) Messages() <-chan Message {
+	msgs := make(chan Message, r.Count())
+	if r.Multiplexed != nil {
+		for _, d := range r.Multiplexed.Devices {
+			msgs <- r.message(d, r.Multiplexed.Payload, SectionMultiplexed)
+		}
+	}
+	for _, d := range r.sortedBatched() {
+		msgs <- r.message(d, (*r.Batched)[d], SectionBatched)
+	}
+	if r.Broadcast != nil {
+		msgs <- r.broadcastMessage()
+	}
+	close(msgs)
+	return msgs
+}
+
+// sortedBatched returns the batched devices sorted, so that they're always
+// sent and reported in the same order.
+func (r *Request) sortedBatched() []string {
+	keys := []string{}
+	if r.Batched != nil {
+		for k := range *r.Batched {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// broadcastMessage is the single message of a Broadcast. Its Token is the
+// topic, as "/topics/<name>", or the condition.
+func (r *Request) broadcastMessage() Message {
+	if r.Broadcast.Condition != "" {
+		msg := r.message(r.Broadcast.Condition, r.Broadcast.Payload, SectionBroadcast)
+		msg.Broadcast = BroadcastCondition
+		return msg
+	}
+	msg := r.message("/topics/"+r.Broadcast.Topic, r.Broadcast.Payload, SectionBroadcast)
+	msg.Broadcast = BroadcastTopic
+	return msg
 }
 
 func (r Request) Count() int64 {
-	r.initialize()
-	return int64(r.total)
+	var total int
+	if r.Multiplexed != nil {
+		total += len(r.Multiplexed.Devices)
+	}
+	if r.Batched != nil {
+		total += len(*r.Batched)
+	}
+	if r.Broadcast != nil {
+		total++
+	}
+	return int64(total)
+}
+
+// Subset returns a copy of the request addressing only the given devices,
+// keeping each device's payload.
+func (r Request) Subset(tokens []string) Request {
+	sub := Request{
+		PushID:        r.PushID,
+		APNSAuth:      r.APNSAuth,
+		FCMAuth:       r.FCMAuth,
+		CustomID:      r.CustomID,
+		SplitSections: r.SplitSections,
+		APNSIDs:       r.APNSIDs,
+		DryRun:        r.DryRun,
+		VerifyTokens:  r.VerifyTokens,
+		TraceID:       r.TraceID,
+		Timeout:       r.Timeout,
+	}
+	wanted := map[string]bool{}
+	for _, t := range tokens {
+		wanted[t] = true
+	}
+	if r.Broadcast != nil && wanted[r.broadcastMessage().Token] {
+		sub.Broadcast = r.Broadcast
+	}
+	sub.Multiplexed, sub.Batched = subsetSections(r.Multiplexed, r.Batched, wanted)
+	if r.APNSTargets != nil {
+		t := &Targets{}
+		t.Multiplexed, t.Batched = subsetSections(r.APNSTargets.Multiplexed, r.APNSTargets.Batched, wanted)
+		if t.Multiplexed != nil || t.Batched != nil {
+			sub.APNSTargets = t
+		}
+	}
+	if r.FCMTargets != nil {
+		t := &Targets{}
+		t.Multiplexed, t.Batched = subsetSections(r.FCMTargets.Multiplexed, r.FCMTargets.Batched, wanted)
+		if t.Multiplexed != nil || t.Batched != nil {
+			sub.FCMTargets = t
+		}
+	}
+	return sub
+}
+
+func subsetSections(multi *Multiplexed, batched *Batched, wanted map[string]bool) (*Multiplexed, *Batched) {
+	var sm *Multiplexed
+	var sb *Batched
+	if multi != nil {
+		m := &Multiplexed{Payload: multi.Payload}
+		for _, d := range multi.Devices {
+			if wanted[d] {
+				m.Devices = append(m.Devices, d)
+			}
+		}
+		if len(m.Devices) > 0 {
+			sm = m
+		}
+	}
+	if batched != nil {
+		b := Batched{}
+		for d, p := range *batched {
+			if wanted[d] {
+				b[d] = p
+			}
+		}
+		if len(b) > 0 {
+			sb = &b
+		}
+	}
+	return sm, sb
 }
 
 func (r *Request) SetDone(f func() error) {
@@ -115,9 +409,41 @@ func (r Request) Done() {
 type Message struct {
 	Token   string
 	Payload json.RawMessage
+	Section string
+	// PushType and Priority are sent to APNS as the apns-push-type and
+	// apns-priority headers. See APNSAuth.
+	PushType string
+	Priority int
+	// Topic, when set, is sent as apns-topic instead of the topic derived
+	// from the certificate, which is the bundle ID with the suffix of the
+	// push type (".voip" for voip pushes, for instance).
+	Topic string
+	// Expiration and CollapseID are sent as apns-expiration and
+	// apns-collapse-id when set.
+	Expiration time.Time
+	CollapseID string
+	// APNSID is sent as apns-id instead of a random UUID when set.
+	APNSID string
+	DryRun bool
+	// Broadcast is BroadcastTopic or BroadcastCondition for the message of
+	// a Broadcast, empty for devices.
+	Broadcast string
+	// TimeToLive and FCMPriority are sent to FCM as time_to_live and
+	// priority when set. See FCMAuth.
+	TimeToLive  *int64
+	FCMPriority string
 }
 
+// Services reported in Response.Service, and returned by Request.Platform.
+const (
+	ServiceAPNS  = "apns"
+	ServiceFCM   = "fcm"
+	ServiceMixed = "mixed"
+)
+
 type Response struct {
+	// Failed is true only when none of the devices could be attempted, in
+	// which case Error says why. Partial failures are reported per device.
 	Failed   bool             `json:"failed"`
 	Error    *Error           `json:"error,omitempty"`
 	Devices  []DeviceResponse `json:"devices,omitempty"`
@@ -125,8 +451,156 @@ type Response struct {
 	Failure  int64            `json:"failure"`
 	PushID   string           `json:"push_id"`
 	CustomID string           `json:"custom_id"`
-	Service  string           `json:"service"`
+	// Service is always set, to ServiceAPNS, ServiceFCM or, for mixed
+	// requests, ServiceMixed. It's only empty on responses to requests
+	// rejected before their platform could be told.
+	Service string `json:"service"`
+	// Sections holds per-section totals when the request set SplitSections.
+	Sections map[string]*SectionSummary `json:"sections,omitempty"`
 	done     func() error
+	// DryRun is set when nothing was actually delivered, see Request.DryRun.
+	DryRun bool `json:"dry_run,omitempty"`
+	// TraceID is the TraceID of the request.
+	TraceID string `json:"trace_id,omitempty"`
+	// Unregistered lists the identifiers of the devices whose tokens the
+	// provider reported as permanently invalid, see
+	// DeviceResponse.Unregistered.
+	Unregistered []string `json:"unregistered,omitempty"`
+}
+
+// FailedResponse builds the response of a request none of whose devices
+// could be attempted, reporting e both at the top level and for every device.
+func FailedResponse(r Request, service string, e *Error) Response {
+	resp := Response{
+		Failed:   true,
+		Error:    e,
+		Devices:  []DeviceResponse{},
+		Failure:  r.Count(),
+		PushID:   r.PushID,
+		CustomID: r.CustomID,
+		Service:  service,
+		DryRun:   r.DryRun,
+	}
+	for msg := range r.Messages() {
+		resp.Devices = append(resp.Devices, DeviceResponse{Identifier: msg.Token, Section: msg.Section, Error: e})
+	}
+	if r.SplitSections {
+		resp.SummarizeSections()
+	}
+	return resp
+}
+
+// MergeResponses combines the responses to the platform parts of a mixed
+// request. The result is Failed only when both parts are.
+func MergeResponses(a, b Response) Response {
+	resp := Response{
+		Failed:   a.Failed && b.Failed,
+		Devices:  append(append([]DeviceResponse{}, a.Devices...), b.Devices...),
+		Success:  a.Success + b.Success,
+		Failure:  a.Failure + b.Failure,
+		PushID:   a.PushID,
+		CustomID: a.CustomID,
+		Service:  ServiceMixed,
+		DryRun:   a.DryRun || b.DryRun,
+	}
+	if len(a.Unregistered) > 0 || len(b.Unregistered) > 0 {
+		resp.Unregistered = append(append([]string{}, a.Unregistered...), b.Unregistered...)
+	}
+	if resp.Failed {
+		resp.Error = a.Error
+	}
+	if a.Sections != nil || b.Sections != nil {
+		resp.Sections = map[string]*SectionSummary{}
+		for _, sections := range []map[string]*SectionSummary{a.Sections, b.Sections} {
+			for name, sum := range sections {
+				merged, ok := resp.Sections[name]
+				if !ok {
+					merged = &SectionSummary{}
+					resp.Sections[name] = merged
+				}
+				merged.Success += sum.Success
+				merged.Failure += sum.Failure
+			}
+		}
+	}
+	return resp
+}
+
+type SectionSummary struct {
+	Success int64 `json:"success"`
+	Failure int64 `json:"failure"`
+}
+
+// Retryable returns the identifiers of the devices flagged for retry.
+func (r Response) Retryable() []string {
+	devices := []string{}
+	for _, d := range r.Devices {
+		if d.ShouldRetry || (d.Error != nil && d.Error.ShouldRetry) {
+			devices = append(devices, d.Identifier)
+		}
+	}
+	return devices
+}
+
+// SortDevices puts Devices back in the order of the messages of req:
+// multiplexed devices as given, then batched ones sorted by token, then the
+// broadcast. Devices that don't belong to req are left at the end.
+func (r *Response) SortDevices(req Request) {
+	positions := map[string][]int{}
+	i := 0
+	for msg := range req.Messages() {
+		positions[msg.Token] = append(positions[msg.Token], i)
+		i++
+	}
+	sorted := make([]DeviceResponse, i)
+	placed := make([]bool, i)
+	var rest []DeviceResponse
+	for _, d := range r.Devices {
+		p := positions[d.Identifier]
+		if len(p) == 0 {
+			rest = append(rest, d)
+			continue
+		}
+		sorted[p[0]] = d
+		placed[p[0]] = true
+		positions[d.Identifier] = p[1:]
+	}
+	devices := make([]DeviceResponse, 0, len(r.Devices))
+	for i, d := range sorted {
+		if placed[i] {
+			devices = append(devices, d)
+		}
+	}
+	r.Devices = append(devices, rest...)
+}
+
+// SummarizeSections fills Sections from the section tags of Devices.
+func (r *Response) SummarizeSections() {
+	r.Sections = map[string]*SectionSummary{}
+	for _, d := range r.Devices {
+		r.CountSection(d)
+	}
+}
+
+// CountSection adds d to the totals of its section, for devices that aren't
+// kept in Devices.
+func (r *Response) CountSection(d DeviceResponse) {
+	if d.Section == "" {
+		return
+	}
+	if r.Sections == nil {
+		r.Sections = map[string]*SectionSummary{}
+	}
+	sum, ok := r.Sections[d.Section]
+	if !ok {
+		sum = &SectionSummary{}
+		r.Sections[d.Section] = sum
+	}
+	if d.Delivered {
+		sum.Success++
+	} else {
+		sum.Failure++
+	}
 }
 
 func (r *Response) SetDone(f func() error) {
@@ -144,6 +618,34 @@ type Error struct {
 	Code        int64      `json:"code"`
 	ShouldRetry bool       `json:"should_retry"`
 	RetryAt     *time.Time `json:"retry_at,omitempty"`
+	// Kind classifies connection-level failures, see the Kind constants.
+	Kind string `json:"kind,omitempty"`
+}
+
+// Kinds of connection-level failures reported in Error.Kind.
+const (
+	KindRefusedStream   = "refused_stream"
+	KindStreamReset     = "stream_reset"
+	KindGoAway          = "goaway"
+	KindConnectionReset = "connection_reset"
+	KindTimeout         = "timeout"
+	KindNetwork         = "network"
+	KindCanceled        = "canceled"
+)
+
+// CanceledResponse is the response of a device that wasn't sent because the
+// context of its request was done.
+func CanceledResponse(m Message, err error) DeviceResponse {
+	return DeviceResponse{
+		Identifier: m.Token,
+		Section:    m.Section,
+		Error: &Error{
+			Code:        499,
+			Description: "canceled: " + err.Error(),
+			ShouldRetry: true,
+			Kind:        KindCanceled,
+		},
+	}
 }
 
 type DeviceResponse struct {
@@ -152,14 +654,140 @@ type DeviceResponse struct {
 	Error       *Error `json:"error,omitempty"`
 	ShouldRetry bool   `json:"should_retry,omitempty"`
 	Canonical   string `json:"canonical,omitempty"`
+	// MessageID is the provider's identifier for a delivered push (FCM's
+	// message_id).
+	MessageID string `json:"message_id,omitempty"`
+	// MulticastID is the multicast_id of the legacy FCM call the device was
+	// sent in, which FCM support asks for when investigating deliveries.
+	MulticastID int64  `json:"multicast_id,omitempty"`
+	Section     string `json:"section,omitempty"`
+	// APNSID is the apns-id of the push, as echoed back by APNS.
+	APNSID string `json:"apns_id,omitempty"`
+	// Unregistered is set when the provider reported the token as no longer
+	// valid. Such devices are never retried and should be removed.
+	// UnregisteredAt, when known, is when the token stopped being valid.
+	Unregistered   bool       `json:"unregistered,omitempty"`
+	UnregisteredAt *time.Time `json:"unregistered_at,omitempty"`
+	// SentAt is when the push was sent to the provider and Latency how long
+	// the provider took to answer, retries included. They're only set when
+	// the provider answered with a success, and Latency is marshaled in
+	// milliseconds as latency_ms.
+	SentAt  *time.Time    `json:"sent_at,omitempty"`
+	Latency time.Duration `json:"-"`
+}
+
+// SetTiming sets SentAt to start and Latency to the time elapsed since.
+func (d *DeviceResponse) SetTiming(start time.Time) {
+	d.SentAt = &start
+	d.Latency = time.Since(start)
+}
+
+func (d DeviceResponse) MarshalJSON() ([]byte, error) {
+	type plain DeviceResponse
+	return json.Marshal(struct {
+		plain
+		LatencyMS int64 `json:"latency_ms,omitempty"`
+	}{plain(d), d.Latency.Milliseconds()})
 }
 
+func (d *DeviceResponse) UnmarshalJSON(data []byte) error {
+	type plain DeviceResponse
+	aux := struct {
+		*plain
+		LatencyMS int64 `json:"latency_ms"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	d.Latency = time.Duration(aux.LatencyMS) * time.Millisecond
+	return nil
+}
+
+// FCMAuth carries either a legacy server AuthKey or, for the HTTP v1 API, a
+// service account JSON (raw or base64 encoded). ProjectID overrides the
+// project found in the service account.
 type FCMAuth struct {
-	AuthKey string `json:"auth_key"`
+	AuthKey        string `json:"auth_key"`
+	ServiceAccount string `json:"service_account,omitempty"`
+	ProjectID      string `json:"project_id,omitempty"`
+	// TimeToLive, in seconds, and Priority (FCMPriorityHigh or
+	// FCMPriorityNormal) apply to every push of the request, overriding
+	// the payload. FCM's defaults are used when they're unset.
+	TimeToLive *int64 `json:"time_to_live,omitempty"`
+	Priority   string `json:"priority,omitempty"`
+	// DeviceAuthKeys maps devices to the legacy auth key of their Firebase
+	// project, for requests addressing several projects. Devices that
+	// aren't listed use AuthKey.
+	DeviceAuthKeys map[string]string `json:"device_auth_keys,omitempty"`
+}
+
+// KeyFor returns the legacy auth key to push to device with.
+func (a FCMAuth) KeyFor(device string) string {
+	if k, ok := a.DeviceAuthKeys[device]; ok && k != "" {
+		return k
+	}
+	return a.AuthKey
 }
 
+// Priorities of FCMAuth.Priority.
+const (
+	FCMPriorityHigh   = "high"
+	FCMPriorityNormal = "normal"
+)
+
+// MaxFCMTimeToLive is the longest time to live, in seconds, FCM accepts.
+const MaxFCMTimeToLive = 2419200
+
+// UsesV1 tells whether the request goes through the FCM HTTP v1 API.
+func (a FCMAuth) UsesV1() bool {
+	return a.ServiceAccount != ""
+}
+
+// ValidateOptions reports invalid TimeToLive and Priority values.
+func (a FCMAuth) ValidateOptions() error {
+	if a.TimeToLive != nil && (*a.TimeToLive < 0 || *a.TimeToLive > MaxFCMTimeToLive) {
+		return errors.Errorf("fcm time_to_live must be between 0 and %d", MaxFCMTimeToLive)
+	}
+	if a.Priority != "" && a.Priority != FCMPriorityHigh && a.Priority != FCMPriorityNormal {
+		return errors.Errorf("fcm priority must be %q or %q", FCMPriorityHigh, FCMPriorityNormal)
+	}
+	return nil
+}
+
+// APNSAuth carries either a certificate or, for token-based authentication,
+// a .p8 AuthKey with its KeyID and TeamID. Token-based requests must also set
+// Topic, since there's no certificate to derive it from. Certificate-based
+// ones may set it to override the topic found in the certificate.
 type APNSAuth struct {
 	Certificate         string `json:"certificate"`
 	CertificatePassword string `json:"certificate_password"`
 	Sandbox             bool   `json:"sandbox"`
+	AuthKey             string `json:"auth_key,omitempty"`
+	KeyID               string `json:"key_id,omitempty"`
+	TeamID              string `json:"team_id,omitempty"`
+	Topic               string `json:"topic,omitempty"`
+	// PushType and Priority apply to every push of the request, defaulting
+	// to "alert" and 10 (or 5 for background pushes).
+	PushType string `json:"push_type,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// Expiration, when set, is the time after which APNS stops trying to
+	// deliver the pushes. CollapseID groups notifications so that only the
+	// latest is displayed, it must be at most 64 bytes.
+	Expiration *time.Time `json:"expiration,omitempty"`
+	CollapseID string     `json:"collapse_id,omitempty"`
+	// CertificateFormat is either CertificateFormatPEM or
+	// CertificateFormatPKCS12. It's detected from the certificate when empty.
+	CertificateFormat string `json:"certificate_format,omitempty"`
+}
+
+// Formats of APNSAuth.Certificate, once base64 decoded.
+const (
+	CertificateFormatPEM    = "pem"
+	CertificateFormatPKCS12 = "p12"
+)
+
+// UsesToken tells whether the request authenticates with a provider token
+// rather than a certificate.
+func (a APNSAuth) UsesToken() bool {
+	return a.AuthKey != ""
 }
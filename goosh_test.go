@@ -0,0 +1,43 @@
+package goosh
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIteratorMatchesMessages(t *testing.T) {
+	payload := json.RawMessage(`{"a":"b"}`)
+	tests := []struct {
+		name string
+		req  Request
+	}{
+		{"multiplexed", Request{Multiplexed: &Multiplexed{Devices: []string{"a", "b"}, Payload: payload}}},
+		{"batched", Request{Batched: &Batched{"b": payload, "a": payload}}},
+		{"broadcast", Request{Broadcast: &Broadcast{Topic: "news", Payload: payload}}},
+		{"all", Request{
+			Multiplexed: &Multiplexed{Devices: []string{"a"}, Payload: payload},
+			Batched:     &Batched{"b": payload},
+			Broadcast:   &Broadcast{Condition: "'news' in topics", Payload: payload},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var iterated []Message
+			for test.req.Next() {
+				iterated = append(iterated, test.req.Value())
+			}
+			var ranged []Message
+			for msg := range test.req.Messages() {
+				ranged = append(ranged, msg)
+			}
+			if int64(len(iterated)) != test.req.Count() || len(ranged) != len(iterated) {
+				t.Fatalf("Count is %d, Next/Value yielded %d messages and Messages %d", test.req.Count(), len(iterated), len(ranged))
+			}
+			for i := range iterated {
+				if iterated[i].Token != ranged[i].Token || iterated[i].Broadcast != ranged[i].Broadcast {
+					t.Fatalf("message %d is %+v from Next/Value and %+v from Messages", i, iterated[i], ranged[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+// Package gooshtest provides a fake PushService and helpers to run the
+// server against it, for tests that shouldn't reach APNS or FCM.
+package gooshtest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/michele/goosh"
+	"github.com/michele/goosh/router"
+	"github.com/michele/goosh/worker"
+)
+
+// MockPushService is a goosh.PushService recording the requests it's given
+// and answering with scripted responses. It's safe for concurrent use.
+type MockPushService struct {
+	// Service is set as the Service of the default responses.
+	Service string
+
+	lock     sync.Mutex
+	requests []goosh.Request
+	script   []result
+}
+
+type result struct {
+	resp goosh.Response
+	err  error
+}
+
+// NewMockPushService returns a mock answering as service, one of the goosh
+// Service constants.
+func NewMockPushService(service string) *MockPushService {
+	return &MockPushService{Service: service}
+}
+
+// Respond queues the response and error returned by the next request. Once
+// the queue is empty every device of a request is reported as delivered.
+func (m *MockPushService) Respond(resp goosh.Response, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.script = append(m.script, result{resp: resp, err: err})
+}
+
+// Requests returns the requests received so far, in order.
+func (m *MockPushService) Requests() []goosh.Request {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]goosh.Request{}, m.requests...)
+}
+
+// Reset forgets the received requests and the queued responses.
+func (m *MockPushService) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests = nil
+	m.script = nil
+}
+
+func (m *MockPushService) Process(r goosh.Request) (goosh.Response, error) {
+	return m.ProcessContext(context.Background(), r)
+}
+
+func (m *MockPushService) ProcessContext(ctx context.Context, r goosh.Request) (goosh.Response, error) {
+	m.lock.Lock()
+	m.requests = append(m.requests, r)
+	if len(m.script) > 0 {
+		res := m.script[0]
+		m.script = m.script[1:]
+		m.lock.Unlock()
+		return res.resp, res.err
+	}
+	m.lock.Unlock()
+	return m.delivered(r), nil
+}
+
+// delivered is the response reporting every device of r as delivered.
+func (m *MockPushService) delivered(r goosh.Request) goosh.Response {
+	resp := goosh.Response{
+		Devices:  []goosh.DeviceResponse{},
+		PushID:   r.PushID,
+		CustomID: r.CustomID,
+		Service:  m.Service,
+		DryRun:   r.DryRun,
+	}
+	for msg := range r.Messages() {
+		resp.Devices = append(resp.Devices, goosh.DeviceResponse{Identifier: msg.Token, Delivered: true, Section: msg.Section})
+		resp.Success++
+	}
+	if r.SplitSections {
+		resp.SummarizeSections()
+	}
+	return resp
+}
+
+// Server is a running router.Server backed by mock services.
+type Server struct {
+	*httptest.Server
+	Router *router.Server
+	APNS   *MockPushService
+	FCM    *MockPushService
+	// CB is the worker group delivering callbacks.
+	CB *worker.WorkerGroup
+}
+
+// NewServer starts a router.Server whose APNS and FCM services are mocks,
+// applying options after them. Close it when done.
+func NewServer(options ...func(*router.Server)) *Server {
+	ts := &Server{
+		APNS: NewMockPushService(goosh.ServiceAPNS),
+		FCM:  NewMockPushService(goosh.ServiceFCM),
+		CB:   worker.NewWorkerGroup(1),
+	}
+	ts.CB.Start()
+	options = append([]func(*router.Server){func(s *router.Server) {
+		s.APNS = ts.APNS
+		s.FCM = ts.FCM
+		s.CB = ts.CB
+	}}, options...)
+	ts.Router = router.NewServer(options...)
+	ts.Server = httptest.NewServer(ts.Router)
+	return ts
+}
+
+// Close shuts the server down and stops its callback workers.
+func (ts *Server) Close() {
+	ts.Server.Close()
+	ts.CB.Stop()
+}
+
+// CallbackRecorder is an HTTP server recording the responses POSTed to it
+// as callbacks.
+type CallbackRecorder struct {
+	*httptest.Server
+	// Received gets every callback as it arrives.
+	Received chan goosh.Response
+
+	lock      sync.Mutex
+	responses []goosh.Response
+	headers   []http.Header
+}
+
+// NewCallbackRecorder starts a CallbackRecorder, its URL is meant to be used
+// as the callback of async pushes. Close it when done.
+func NewCallbackRecorder() *CallbackRecorder {
+	cr := &CallbackRecorder{Received: make(chan goosh.Response, 100)}
+	cr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		var resp goosh.Response
+		if err == nil {
+			err = json.Unmarshal(body, &resp)
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		cr.lock.Lock()
+		cr.responses = append(cr.responses, resp)
+		cr.headers = append(cr.headers, r.Header)
+		cr.lock.Unlock()
+		select {
+		case cr.Received <- resp:
+		default:
+		}
+		w.WriteHeader(200)
+	}))
+	return cr
+}
+
+// Responses returns the callbacks received so far, in order.
+func (cr *CallbackRecorder) Responses() []goosh.Response {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return append([]goosh.Response{}, cr.responses...)
+}
+
+// Headers returns the headers of the callbacks received so far, in order.
+func (cr *CallbackRecorder) Headers() []http.Header {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return append([]http.Header{}, cr.headers...)
+}
@@ -0,0 +1,128 @@
+package goosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logger is a leveled, structured logger. keyvals alternate keys and
+// values, like "push_id", id, "status", 500.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level named s, LevelInfo when s isn't a level.
+func ParseLevel(s string) Level {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l
+		}
+	}
+	return LevelInfo
+}
+
+// redactedKeys are the keys whose values never make it to the logs.
+var redactedKeys = map[string]bool{
+	"certificate":          true,
+	"certificate_password": true,
+	"auth_key":             true,
+	"service_account":      true,
+	"authorization":        true,
+}
+
+// RedactedValue replaces secrets in logs.
+const RedactedValue = "[REDACTED]"
+
+// NewLogger returns a Logger writing one JSON object per entry to l,
+// dropping the entries below level.
+func NewLogger(l *log.Logger, level Level) Logger {
+	return stdLogger{l: l, level: level}
+}
+
+// DefaultLogger logs entries from LevelInfo up to stdout.
+func DefaultLogger() Logger {
+	return NewLogger(log.New(os.Stdout, "", 0), LevelInfo)
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+func (s stdLogger) Debug(msg string, keyvals ...interface{}) { s.log(LevelDebug, msg, keyvals) }
+func (s stdLogger) Info(msg string, keyvals ...interface{})  { s.log(LevelInfo, msg, keyvals) }
+func (s stdLogger) Warn(msg string, keyvals ...interface{})  { s.log(LevelWarn, msg, keyvals) }
+func (s stdLogger) Error(msg string, keyvals ...interface{}) { s.log(LevelError, msg, keyvals) }
+
+func (s stdLogger) log(level Level, msg string, keyvals []interface{}) {
+	if level < s.level {
+		return
+	}
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var v interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		if redactedKeys[strings.ToLower(key)] {
+			v = RedactedValue
+		}
+		entry[key] = logValue(v)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		s.l.Printf("%s %s (couldn't marshal log entry: %v)", level, msg, err)
+		return
+	}
+	s.l.Println(string(line))
+}
+
+// logValue keeps basic values as they are, to be marshaled as JSON, and
+// turns anything else into a string.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string, bool, int, int32, int64, uint, uint32, uint64, float32, float64, []string:
+		return v
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%+v", v)
+	}
+}
@@ -0,0 +1,46 @@
+package goosh
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// MergePayload deep-merges payload over defaults: objects are merged key by
+// key, and for any other value the payload wins. An empty defaults returns
+// payload untouched.
+func MergePayload(defaults, payload json.RawMessage) (json.RawMessage, error) {
+	if len(defaults) == 0 {
+		return payload, nil
+	}
+	var base, over map[string]interface{}
+	err := json.Unmarshal(defaults, &base)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't unmarshal default payload")
+	}
+	err = json.Unmarshal(payload, &over)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't unmarshal payload")
+	}
+	merged, err := json.Marshal(mergeMaps(base, over))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't marshal merged payload")
+	}
+	return merged, nil
+}
+
+func mergeMaps(base, over map[string]interface{}) map[string]interface{} {
+	if base == nil {
+		return over
+	}
+	for k, v := range over {
+		bm, bok := base[k].(map[string]interface{})
+		om, ook := v.(map[string]interface{})
+		if bok && ook {
+			base[k] = mergeMaps(bm, om)
+			continue
+		}
+		base[k] = v
+	}
+	return base
+}
@@ -0,0 +1,165 @@
+// Package payload builds APNS and FCM payloads to use as the payload of a
+// goosh.Multiplexed request or as the values of a goosh.Batched one.
+package payload
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// APNSBuilder builds an APNS payload, nesting the alert and the other
+// system keys under aps.
+type APNSBuilder struct {
+	alert  map[string]interface{}
+	aps    map[string]interface{}
+	custom map[string]interface{}
+	err    error
+}
+
+// NewAPNSBuilder returns a builder for an empty APNS payload.
+func NewAPNSBuilder() *APNSBuilder {
+	return &APNSBuilder{
+		alert:  map[string]interface{}{},
+		aps:    map[string]interface{}{},
+		custom: map[string]interface{}{},
+	}
+}
+
+// Alert sets the title and the body of the alert. Empty values are left out.
+func (b *APNSBuilder) Alert(title, body string) *APNSBuilder {
+	if title != "" {
+		b.alert["title"] = title
+	}
+	if body != "" {
+		b.alert["body"] = body
+	}
+	return b
+}
+
+// LocalizedAlert sets the alert body to the localized string key of the
+// app, formatted with args.
+func (b *APNSBuilder) LocalizedAlert(key string, args ...string) *APNSBuilder {
+	b.alert["loc-key"] = key
+	if len(args) > 0 {
+		b.alert["loc-args"] = args
+	}
+	return b
+}
+
+// Badge sets the badge of the app icon. Zero removes the badge.
+func (b *APNSBuilder) Badge(n int) *APNSBuilder {
+	b.aps["badge"] = n
+	return b
+}
+
+// Sound sets the sound to play, "default" being the system one.
+func (b *APNSBuilder) Sound(s string) *APNSBuilder {
+	b.aps["sound"] = s
+	return b
+}
+
+// ContentAvailable marks the notification as a background update.
+func (b *APNSBuilder) ContentAvailable() *APNSBuilder {
+	b.aps["content-available"] = 1
+	return b
+}
+
+// MutableContent lets a notification service extension modify the
+// notification before it's shown.
+func (b *APNSBuilder) MutableContent() *APNSBuilder {
+	b.aps["mutable-content"] = 1
+	return b
+}
+
+// Custom sets a custom key next to aps.
+func (b *APNSBuilder) Custom(key string, v interface{}) *APNSBuilder {
+	if key == "aps" {
+		b.err = errors.New("aps is reserved for the system keys")
+		return b
+	}
+	b.custom[key] = v
+	return b
+}
+
+// Build returns the payload.
+func (b *APNSBuilder) Build() (json.RawMessage, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	aps := map[string]interface{}{}
+	for k, v := range b.aps {
+		aps[k] = v
+	}
+	if len(b.alert) > 0 {
+		aps["alert"] = b.alert
+	}
+	p := map[string]interface{}{"aps": aps}
+	for k, v := range b.custom {
+		p[k] = v
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't marshal APNS payload")
+	}
+	return raw, nil
+}
+
+// FCMBuilder builds an FCM payload made of a notification and data.
+type FCMBuilder struct {
+	notification map[string]string
+	data         map[string]string
+}
+
+// NewFCMBuilder returns a builder for an empty FCM payload.
+func NewFCMBuilder() *FCMBuilder {
+	return &FCMBuilder{
+		notification: map[string]string{},
+		data:         map[string]string{},
+	}
+}
+
+// Notification sets the title and the body of the notification. Empty
+// values are left out.
+func (b *FCMBuilder) Notification(title, body string) *FCMBuilder {
+	if title != "" {
+		b.notification["title"] = title
+	}
+	if body != "" {
+		b.notification["body"] = body
+	}
+	return b
+}
+
+// Sound sets the sound of the notification.
+func (b *FCMBuilder) Sound(s string) *FCMBuilder {
+	b.notification["sound"] = s
+	return b
+}
+
+// Data sets a key of the data delivered to the app. FCM only takes
+// string values.
+func (b *FCMBuilder) Data(key, value string) *FCMBuilder {
+	b.data[key] = value
+	return b
+}
+
+// Build returns the payload. It fails when neither a notification nor data
+// was set, since FCM would have nothing to deliver.
+func (b *FCMBuilder) Build() (json.RawMessage, error) {
+	p := map[string]interface{}{}
+	if len(b.notification) > 0 {
+		p["notification"] = b.notification
+	}
+	if len(b.data) > 0 {
+		p["data"] = b.data
+	}
+	if len(p) == 0 {
+		return nil, errors.New("FCM payload has neither notification nor data")
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't marshal FCM payload")
+	}
+	return raw, nil
+}
@@ -0,0 +1,108 @@
+package goosh
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRateLimited is returned by RateLimiter.Wait when the context would be
+// done before a token is available.
+var ErrRateLimited = errors.New("rate limit would exceed the deadline")
+
+// maxIdleBuckets is how many buckets a RateLimiter keeps before dropping
+// the full ones, which are the same as new buckets.
+const maxIdleBuckets = 1024
+
+// RateLimiter is a token bucket per key, such as a certificate or an auth
+// key, refilled at Rate tokens per second up to Burst tokens.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate tokens per second and
+// bursts of burst tokens for every key. A burst lower than one is one.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{Rate: rate, Burst: burst, buckets: map[string]*bucket{}}
+}
+
+// Wait takes a token of key, waiting for one when there's none left. It
+// gives up right away, returning ErrRateLimited, when ctx has a deadline
+// earlier than the token, and returns ctx's error if it's done meanwhile.
+func (l *RateLimiter) Wait(ctx context.Context, key string) error {
+	if l.Rate <= 0 {
+		return ctx.Err()
+	}
+	now := time.Now()
+	l.lock.Lock()
+	b := l.bucket(key, now)
+	var delay time.Duration
+	if b.tokens < 1 {
+		delay = time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		l.lock.Unlock()
+		return ErrRateLimited
+	}
+	b.tokens--
+	l.lock.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		b.tokens++
+		l.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// bucket returns the refilled bucket of key. It must be called with l.lock
+// held.
+func (l *RateLimiter) bucket(key string, now time.Time) *bucket {
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropFull(now)
+		}
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+	return b
+}
+
+func (l *RateLimiter) dropFull(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
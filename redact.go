@@ -0,0 +1,83 @@
+package goosh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Redacted returns a copy of the credentials with the certificate, its
+// password and the auth key replaced by RedactedValue.
+func (a APNSAuth) Redacted() APNSAuth {
+	a.Certificate = redact(a.Certificate)
+	a.CertificatePassword = redact(a.CertificatePassword)
+	a.AuthKey = redact(a.AuthKey)
+	return a
+}
+
+// String formats the credentials without their secrets, so that they're
+// safe to log.
+func (a APNSAuth) String() string {
+	type plain APNSAuth
+	return fmt.Sprintf("%+v", plain(a.Redacted()))
+}
+
+func (a APNSAuth) GoString() string {
+	type plain APNSAuth
+	return goString("goosh.APNSAuth", fmt.Sprintf("%#v", plain(a.Redacted())))
+}
+
+// Redacted returns a copy of the credentials with the auth keys and the
+// service account replaced by RedactedValue.
+func (a FCMAuth) Redacted() FCMAuth {
+	a.AuthKey = redact(a.AuthKey)
+	a.ServiceAccount = redact(a.ServiceAccount)
+	if a.DeviceAuthKeys != nil {
+		keys := make(map[string]string, len(a.DeviceAuthKeys))
+		for d, k := range a.DeviceAuthKeys {
+			keys[d] = redact(k)
+		}
+		a.DeviceAuthKeys = keys
+	}
+	return a
+}
+
+// String formats the credentials without their secrets, so that they're
+// safe to log.
+func (a FCMAuth) String() string {
+	type plain FCMAuth
+	return fmt.Sprintf("%+v", plain(a.Redacted()))
+}
+
+func (a FCMAuth) GoString() string {
+	type plain FCMAuth
+	return goString("goosh.FCMAuth", fmt.Sprintf("%#v", plain(a.Redacted())))
+}
+
+// Redacted returns a copy of the request whose credentials are redacted,
+// for logging it as JSON. It can't be sent anymore.
+func (r Request) Redacted() Request {
+	if r.APNSAuth != nil {
+		a := r.APNSAuth.Redacted()
+		r.APNSAuth = &a
+	}
+	if r.FCMAuth != nil {
+		a := r.FCMAuth.Redacted()
+		r.FCMAuth = &a
+	}
+	return r
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return RedactedValue
+}
+
+// goString replaces the name of the local type %#v prints with name.
+func goString(name string, s string) string {
+	if i := strings.Index(s, "{"); i >= 0 {
+		return name + s[i:]
+	}
+	return s
+}
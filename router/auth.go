@@ -0,0 +1,141 @@
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// withAuth refuses requests with a 401 unless their Authorization header is
+// either "Bearer <AuthToken>" or "HMAC <signature>", the signature being the
+// hex encoded HMAC-SHA256 of the raw body keyed with AuthSecret. Requests go
+// through untouched when neither is configured.
+func (s *Server) withAuth(next http.Handler) http.Handler {
+	return s.auth(next, false)
+}
+
+// withStreamingAuth is withAuth for handlers streaming their body: the HMAC
+// signature is computed as the body is read, through a signedBody, and
+// next must check it with signed before acting on the body.
+func (s *Server) withStreamingAuth(next http.Handler) http.Handler {
+	return s.auth(next, true)
+}
+
+func (s *Server) auth(next http.Handler, streaming bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.AuthToken == "" && s.AuthSecret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme, credentials := splitAuthorization(r.Header.Get("Authorization"))
+		switch {
+		case scheme == "bearer" && s.AuthToken != "":
+			if subtle.ConstantTimeCompare([]byte(credentials), []byte(s.AuthToken)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		case scheme == "hmac" && s.AuthSecret != "" && streaming:
+			signature, err := hex.DecodeString(credentials)
+			if err != nil {
+				break
+			}
+			r.Body = &signedBody{ReadCloser: r.Body, mac: hmac.New(sha256.New, []byte(s.AuthSecret)), signature: signature}
+			next.ServeHTTP(w, r)
+			return
+		case scheme == "hmac" && s.AuthSecret != "":
+			body, err := ioutil.ReadAll(r.Body)
+			if bodyTooLarge(err) {
+				http.Error(w, "", 413)
+				return
+			}
+			if err != nil {
+				s.Log.Error("Couldn't read body to check its signature", "error", err, "remote", r.RemoteAddr)
+				http.Error(w, "", 500)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if validSignature(body, credentials, s.AuthSecret) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		unauthorized(w)
+	})
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "", 401)
+}
+
+// signedBody computes the HMAC of a body as it's read, see
+// withStreamingAuth.
+type signedBody struct {
+	io.ReadCloser
+	mac       hash.Hash
+	signature []byte
+	eof       bool
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mac.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// signed tells whether the body of r, when it's a signedBody, matches its
+// signature. What's left of the body is read to tell.
+func signed(r *http.Request) bool {
+	b, ok := r.Body.(*signedBody)
+	if !ok {
+		return true
+	}
+	if !b.eof {
+		io.Copy(ioutil.Discard, b)
+	}
+	return b.eof && hmac.Equal(b.signature, b.mac.Sum(nil))
+}
+
+func splitAuthorization(header string) (scheme string, credentials string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.ToLower(parts[0]), strings.TrimSpace(parts[1])
+}
+
+func validSignature(body []byte, signature string, secret string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// signCallback sets the X-Goosh-Timestamp and X-Goosh-Signature headers of a
+// callback POST. The signature is the hex encoded HMAC-SHA256, keyed with
+// secret, of "<push_id>.<timestamp>.<body>", the timestamp being in seconds
+// since the epoch. Receivers should recompute it and refuse stale timestamps
+// to guard against replays.
+func signCallback(req *http.Request, pushID string, body []byte, secret string, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(pushID + "." + ts + "."))
+	mac.Write(body)
+	req.Header.Set("X-Goosh-Timestamp", ts)
+	req.Header.Set("X-Goosh-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
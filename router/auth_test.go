@@ -0,0 +1,73 @@
+package router
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/michele/goosh"
+)
+
+// countingService answers every push right away, counting them.
+type countingService struct {
+	pushes int64
+}
+
+func (cs *countingService) Process(r goosh.Request) (goosh.Response, error) {
+	return cs.ProcessContext(context.Background(), r)
+}
+
+func (cs *countingService) ProcessContext(ctx context.Context, r goosh.Request) (goosh.Response, error) {
+	atomic.AddInt64(&cs.pushes, 1)
+	return goosh.Response{Service: goosh.ServiceFCM, Success: r.Count()}, nil
+}
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestStreamingHMACAuth(t *testing.T) {
+	cs := &countingService{}
+	s := NewServer(func(s *Server) {
+		s.Logger = log.New(ioutil.Discard, "", 0)
+		s.FCM = cs
+		s.AuthSecret = "secret"
+	})
+	tests := []struct {
+		name      string
+		body      string
+		signature string
+		code      int
+		pushed    bool
+	}{
+		{"signed", fcmPush, sign(fcmPush, "secret"), 200, true},
+		{"wrong secret", fcmPush, sign(fcmPush, "other"), 401, false},
+		{"tampered", strings.Replace(fcmPush, "device", "other", 1), sign(fcmPush, "secret"), 401, false},
+		{"not hex", fcmPush, "zz", 401, false},
+		{"malformed and signed", `{"push_id":`, sign(`{"push_id":`, "secret"), 400, false},
+		{"malformed and unsigned", `{"push_id":`, sign(fcmPush, "secret"), 401, false},
+		{"unsigned after the request", fcmPush + " x", sign(fcmPush, "secret"), 401, false},
+	}
+	for _, test := range tests {
+		before := atomic.LoadInt64(&cs.pushes)
+		req := httptest.NewRequest("POST", "/push", strings.NewReader(test.body))
+		req.Header.Set("Authorization", "HMAC "+test.signature)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s: got a %d, want a %d", test.name, w.Code, test.code)
+		}
+		if pushed := atomic.LoadInt64(&cs.pushes) > before; pushed != test.pushed {
+			t.Errorf("%s: pushed is %t, want %t", test.name, pushed, test.pushed)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/michele/goosh"
+)
+
+func testCallback(url string, maxBackoff time.Duration, attempts *int) callback {
+	return callback{
+		url:            url,
+		response:       goosh.Response{PushID: "push"},
+		maxRetries:     3,
+		initialBackoff: time.Millisecond,
+		maxBackoff:     maxBackoff,
+		log:            goosh.NewLogger(log.New(ioutil.Discard, "", 0), goosh.LevelInfo),
+		instrument: func(success bool, n int, took time.Duration) {
+			*attempts = n
+		},
+	}
+}
+
+func TestCallbackRetryAfterIsCapped(t *testing.T) {
+	var calls, conns int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) < 3 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	var attempts int
+	done := make(chan bool)
+	go func() {
+		testCallback(ts.URL, 10*time.Millisecond, &attempts).Work()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback waited for the whole Retry-After")
+	}
+	if attempts != 3 {
+		t.Fatalf("took %d attempts, want 3", attempts)
+	}
+	// Closed bodies let the attempts share a connection.
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Fatalf("opened %d connections, want 1", n)
+	}
+}
+
+func TestCallbackBadURLIsNotRetried(t *testing.T) {
+	var attempts int
+	testCallback("http://bad url", 0, &attempts).Work()
+	if attempts != 1 {
+		t.Fatalf("took %d attempts, want 1", attempts)
+	}
+}
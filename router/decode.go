@@ -0,0 +1,298 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/michele/goosh"
+	"github.com/pkg/errors"
+)
+
+// errReader remembers the error its reader failed with, so that a body
+// that couldn't be read can be told from a malformed one.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// decodeRequest reads a Request from body as it arrives, rather than from
+// a copy of the whole body. The device lists, which make up most of the
+// large pushes, are decoded one device at a time straight into the
+// Multiplexed and Batched sections; the other fields are small and each
+// unmarshaled into its field of the Request. Every value is checked against
+// b as it's read.
+//
+// Devices are only dispatched once the whole request is decoded, since the
+// credentials, the validation and MaxDevices need all of it.
+func decodeRequest(body io.Reader, b *jsonBudget) (goosh.Request, error) {
+	var req goosh.Request
+	dec := json.NewDecoder(body)
+	tok, err := dec.Token()
+	if err != nil {
+		return req, errors.Wrap(err, "couldn't read the request")
+	}
+	if tok == nil {
+		return req, decodeEnd(dec)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return req, errors.New("the request isn't a JSON object")
+	}
+	fields := reflect.ValueOf(&req).Elem()
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return req, errors.Wrap(err, "couldn't read the request")
+		}
+		key := tok.(string)
+		if err := b.countKey(); err != nil {
+			return req, err
+		}
+		// Field names are matched the way json.Unmarshal does.
+		switch {
+		case strings.EqualFold(key, "batched"):
+			req.Batched, err = decodeBatched(dec, b, 1, req.Batched)
+		case strings.EqualFold(key, "multiplexed"):
+			req.Multiplexed, err = decodeMultiplexed(dec, b, 1, req.Multiplexed)
+		case strings.EqualFold(key, "apns_targets"):
+			req.APNSTargets, err = decodeTargets(dec, b, 1, req.APNSTargets)
+		case strings.EqualFold(key, "fcm_targets"):
+			req.FCMTargets, err = decodeTargets(dec, b, 1, req.FCMTargets)
+		default:
+			err = decodeValue(dec, b, 1, key, requestField(fields, key))
+		}
+		if err != nil {
+			return req, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return req, errors.Wrap(err, "couldn't read the request")
+	}
+	return req, decodeEnd(dec)
+}
+
+// requestFields maps the JSON names of the fields of a Request to their
+// index.
+var requestFields = func() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(goosh.Request{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = i
+	}
+	return fields
+}()
+
+// requestField returns the field of the Request fields named key in JSON,
+// preferring an exact match like json.Unmarshal does. The returned Value
+// is invalid for unknown keys.
+func requestField(fields reflect.Value, key string) reflect.Value {
+	if i, ok := requestFields[key]; ok {
+		return fields.Field(i)
+	}
+	for name, i := range requestFields {
+		if strings.EqualFold(name, key) {
+			return fields.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// decodeValue reads the value of key, found depth levels deep, and
+// unmarshals it into field unless field is invalid, in which case the value
+// is only checked against b.
+func decodeValue(dec *json.Decoder, b *jsonBudget, depth int, key string, field reflect.Value) error {
+	var value json.RawMessage
+	if err := dec.Decode(&value); err != nil {
+		return errors.Wrapf(err, "couldn't read %q", key)
+	}
+	if err := b.check(value, depth); err != nil {
+		return err
+	}
+	if !field.IsValid() {
+		return nil
+	}
+	return json.Unmarshal(value, field.Addr().Interface())
+}
+
+// openObject reads the start of an object found depth levels deep. It
+// returns false for a null.
+func openObject(dec *json.Decoder, b *jsonBudget, depth int, key string) (bool, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't read %q", key)
+	}
+	if tok == nil {
+		return false, nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return false, errors.Errorf("%q isn't a JSON object", key)
+	}
+	if b.maxDepth > 0 && depth >= b.maxDepth {
+		return false, complexityError{errors.Errorf("body is nested deeper than %d levels", b.maxDepth)}
+	}
+	return true, nil
+}
+
+// closeObject reads the end of an object opened by openObject.
+func closeObject(dec *json.Decoder, key string) error {
+	if _, err := dec.Token(); err != nil {
+		return errors.Wrapf(err, "couldn't read %q", key)
+	}
+	return nil
+}
+
+// decodeBatched reads batched devices, found depth levels deep, into
+// batched, allocating it when it's nil. A null section sets it to nil, as
+// json.Unmarshal would.
+func decodeBatched(dec *json.Decoder, b *jsonBudget, depth int, batched *goosh.Batched) (*goosh.Batched, error) {
+	ok, err := openObject(dec, b, depth, "batched")
+	if !ok {
+		return nil, err
+	}
+	if batched == nil || *batched == nil {
+		batched = &goosh.Batched{}
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return batched, errors.Wrap(err, "couldn't read \"batched\"")
+		}
+		if err := b.countKey(); err != nil {
+			return batched, err
+		}
+		var payload json.RawMessage
+		if err := dec.Decode(&payload); err != nil {
+			return batched, errors.Wrapf(err, "couldn't read the payload of %q", tok)
+		}
+		if err := b.check(payload, depth+1); err != nil {
+			return batched, err
+		}
+		(*batched)[tok.(string)] = payload
+	}
+	return batched, closeObject(dec, "batched")
+}
+
+// decodeMultiplexed reads a multiplexed section, found depth levels deep,
+// into m, allocating it when it's nil. The devices are read one at a time.
+func decodeMultiplexed(dec *json.Decoder, b *jsonBudget, depth int, m *goosh.Multiplexed) (*goosh.Multiplexed, error) {
+	ok, err := openObject(dec, b, depth, "multiplexed")
+	if !ok {
+		return nil, err
+	}
+	if m == nil {
+		m = &goosh.Multiplexed{}
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return m, errors.Wrap(err, "couldn't read \"multiplexed\"")
+		}
+		key := tok.(string)
+		if err := b.countKey(); err != nil {
+			return m, err
+		}
+		switch {
+		case strings.EqualFold(key, "devices"):
+			m.Devices, err = decodeDevices(dec, b, depth+1, m.Devices)
+		case strings.EqualFold(key, "payload"):
+			if err = dec.Decode(&m.Payload); err != nil {
+				return m, errors.Wrap(err, "couldn't read \"payload\"")
+			}
+			err = b.check(m.Payload, depth+1)
+		default:
+			err = decodeValue(dec, b, depth+1, key, reflect.Value{})
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, closeObject(dec, "multiplexed")
+}
+
+// decodeDevices reads an array of devices, found depth levels deep. Like
+// json.Unmarshal, it reuses the backing array of devices and sets it to nil
+// for a null.
+func decodeDevices(dec *json.Decoder, b *jsonBudget, depth int, devices []string) ([]string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return devices, errors.Wrap(err, "couldn't read \"devices\"")
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return devices, errors.New("\"devices\" isn't a JSON array")
+	}
+	if b.maxDepth > 0 && depth >= b.maxDepth {
+		return devices, complexityError{errors.Errorf("body is nested deeper than %d levels", b.maxDepth)}
+	}
+	devices = devices[:0]
+	for dec.More() {
+		var device string
+		if err := dec.Decode(&device); err != nil {
+			return devices, errors.Wrap(err, "couldn't read a device")
+		}
+		devices = append(devices, device)
+	}
+	return devices, closeObject(dec, "devices")
+}
+
+// decodeTargets reads the targets of a platform, found depth levels deep,
+// into t, allocating it when it's nil.
+func decodeTargets(dec *json.Decoder, b *jsonBudget, depth int, t *goosh.Targets) (*goosh.Targets, error) {
+	ok, err := openObject(dec, b, depth, "targets")
+	if !ok {
+		return nil, err
+	}
+	if t == nil {
+		t = &goosh.Targets{}
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return t, errors.Wrap(err, "couldn't read the targets")
+		}
+		key := tok.(string)
+		if err := b.countKey(); err != nil {
+			return t, err
+		}
+		switch {
+		case strings.EqualFold(key, "batched"):
+			t.Batched, err = decodeBatched(dec, b, depth+1, t.Batched)
+		case strings.EqualFold(key, "multiplexed"):
+			t.Multiplexed, err = decodeMultiplexed(dec, b, depth+1, t.Multiplexed)
+		default:
+			err = decodeValue(dec, b, depth+1, key, reflect.Value{})
+		}
+		if err != nil {
+			return t, err
+		}
+	}
+	return t, closeObject(dec, "targets")
+}
+
+// decodeEnd fails unless the request is followed by nothing but whitespace,
+// as json.Unmarshal would.
+func decodeEnd(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after the request")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/michele/goosh"
+)
+
+func TestDecodeRequestMatchesUnmarshal(t *testing.T) {
+	bodies := []string{
+		`{"push_id":"p","custom_id":"c","timeout":5,"dry_run":true,"fcm":{"auth_key":"k"},"multiplexed":{"devices":["a","b"],"payload":{"data":{"x":1}}}}`,
+		`{"apns":{"auth_key":"k","key_id":"i","team_id":"t"},"batched":{"a":{"aps":{}},"b":{"aps":{"alert":"hi"}}},"apns_ids":{"a":"id"}}`,
+		`{"apns_targets":{"multiplexed":{"devices":["a"],"payload":{}}},"fcm_targets":{"batched":{"b":{}}},"split_sections":true}`,
+		`{"PUSH_ID":"p","Multiplexed":{"Devices":["a"],"Payload":{}},"unknown":{"x":[1,2]}}`,
+		`{"multiplexed":{"devices":["a"]},"multiplexed":{"devices":["b","c"],"payload":{}}}`,
+		`{"batched":{"a":{}},"batched":{"b":{}}}`,
+		`{"multiplexed":null,"batched":null,"apns_targets":null,"broadcast":{"topic":"news"}}`,
+		`{"multiplexed":{"devices":null,"payload":null}}`,
+		`null`,
+		`{}`,
+	}
+	for _, body := range bodies {
+		var want goosh.Request
+		if err := json.Unmarshal([]byte(body), &want); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		got, err := decodeRequest(strings.NewReader(body), &jsonBudget{})
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded %+v, want %+v", body, got, want)
+		}
+	}
+}
+
+func TestDecodeRequestErrors(t *testing.T) {
+	tests := []struct {
+		body       string
+		budget     jsonBudget
+		complexity bool
+	}{
+		{`[]`, jsonBudget{}, false},
+		{`{"multiplexed":[]}`, jsonBudget{}, false},
+		{`{"multiplexed":{"devices":[1]}}`, jsonBudget{}, false},
+		{`{"push_id":1}`, jsonBudget{}, false},
+		{`{"push_id":"p"} {}`, jsonBudget{}, false},
+		{`{"multiplexed":{"devices":["a"]}`, jsonBudget{}, false},
+		{`{"multiplexed":{"devices":["a"],"payload":{"a":{"b":{}}}}}`, jsonBudget{maxDepth: 4}, true},
+		{`{"multiplexed":{"devices":["a"]}}`, jsonBudget{maxDepth: 2}, true},
+		{`{"apns_targets":{"batched":{"a":{}}}}`, jsonBudget{maxDepth: 3}, true},
+		{`{"batched":{"a":{},"b":{},"c":{}}}`, jsonBudget{maxKeys: 3}, true},
+		{`{"fcm":{"a":1,"b":2,"c":3}}`, jsonBudget{maxKeys: 3}, true},
+	}
+	for _, test := range tests {
+		_, err := decodeRequest(strings.NewReader(test.body), &test.budget)
+		if err == nil {
+			t.Errorf("%s: decoded without error", test.body)
+			continue
+		}
+		if _, ok := err.(complexityError); ok != test.complexity {
+			t.Errorf("%s: got %v, complexity error %t", test.body, err, test.complexity)
+		}
+	}
+	// The same bodies fit budgets one level or key larger.
+	for body, budget := range map[string]jsonBudget{
+		`{"multiplexed":{"devices":["a"],"payload":{"a":{"b":{}}}}}`: {maxDepth: 5},
+		`{"multiplexed":{"devices":["a"]}}`:                          {maxDepth: 3},
+		`{"batched":{"a":{},"b":{}}}`:                                {maxKeys: 3},
+	} {
+		if _, err := decodeRequest(strings.NewReader(body), &budget); err != nil {
+			t.Errorf("%s: %v", body, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/michele/goosh/version"
+)
+
+const defaultReadinessTimeout = 30 * time.Second
+
+// readiness remembers, across /readyz probes, since when the server has
+// been saturated and when the workers last made progress.
+type readiness struct {
+	lock           sync.Mutex
+	saturatedSince time.Time
+	lastProcessed  uint64
+	lastProgress   time.Time
+}
+
+// backoffReporter is implemented by push services able to tell when they
+// were asked to back off altogether, see fcm.PushService.
+type backoffReporter interface {
+	BackingOff() bool
+}
+
+// checkReadiness returns why the server shouldn't get traffic, if it shouldn't.
+func (s *Server) checkReadiness(now time.Time) string {
+	if s.GoingAway() {
+		return "going away"
+	}
+	if b, ok := s.FCM.(backoffReporter); ok && b.BackingOff() {
+		return "FCM asked to back off every auth key"
+	}
+	s.ready.lock.Lock()
+	defer s.ready.lock.Unlock()
+	if !s.saturated() {
+		s.ready.saturatedSince = time.Time{}
+	} else if s.ready.saturatedSince.IsZero() {
+		s.ready.saturatedSince = now
+	}
+	if !s.ready.saturatedSince.IsZero() && now.Sub(s.ready.saturatedSince) > s.ReadinessTimeout {
+		return fmt.Sprintf("%d pushes in flight for %s", s.MaxInFlight, now.Sub(s.ready.saturatedSince).Round(time.Second))
+	}
+	if s.Workers == nil {
+		return ""
+	}
+	st := s.Workers.Stats()
+	if st.Processed != s.ready.lastProcessed || st.Busy == 0 || s.ready.lastProgress.IsZero() {
+		s.ready.lastProcessed = st.Processed
+		s.ready.lastProgress = now
+	}
+	if now.Sub(s.ready.lastProgress) > s.ReadinessTimeout {
+		return fmt.Sprintf("%d busy workers made no progress for %s", st.Busy, now.Sub(s.ready.lastProgress).Round(time.Second))
+	}
+	return ""
+}
+
+// readyHandler serves /readyz: a 503 while the server can't keep up, see
+// ReadinessTimeout, while FCM backs off every auth key, or when it's going
+// away.
+func (s *Server) readyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := s.checkReadiness(time.Now()); reason != "" {
+			http.Error(w, reason, 503)
+			return
+		}
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "OK")
+	})
+}
+
+// versionHandler serves /version: the build information of the server.
+func versionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(version.Get())
+	})
+}
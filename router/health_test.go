@@ -0,0 +1,36 @@
+package router
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+type backingOffService struct {
+	countingService
+	backingOff bool
+}
+
+func (bs *backingOffService) BackingOff() bool {
+	return bs.backingOff
+}
+
+func TestReadinessFCMBackoff(t *testing.T) {
+	fcm := &backingOffService{}
+	s := NewServer(func(s *Server) {
+		s.Logger = log.New(ioutil.Discard, "", 0)
+		s.FCM = fcm
+	})
+	if reason := s.checkReadiness(time.Now()); reason != "" {
+		t.Fatalf("not ready: %s", reason)
+	}
+	fcm.backingOff = true
+	if reason := s.checkReadiness(time.Now()); reason == "" {
+		t.Fatal("ready while FCM backs off every key")
+	}
+	fcm.backingOff = false
+	if reason := s.checkReadiness(time.Now()); reason != "" {
+		t.Fatalf("still not ready once FCM stopped backing off: %s", reason)
+	}
+}
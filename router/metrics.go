@@ -0,0 +1,94 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/michele/goosh/worker"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// instrumentable is implemented by push services exposing the Instrument
+// hooks, see apns2.PushService and fcm.PushService.
+type instrumentable interface {
+	SetInstrumentation(push func(time.Duration), errs func(int))
+}
+
+type metrics struct {
+	registry    *prometheus.Registry
+	pushLatency *prometheus.HistogramVec
+	pushErrors  *prometheus.CounterVec
+	requests    *prometheus.CounterVec
+}
+
+// newMetrics sets up a registry of its own for every Server, so that more
+// than one can live in the same process.
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		pushLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "goosh_push_duration_seconds",
+			Help:    "Time taken by APNS and FCM to accept a push.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service"}),
+		pushErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "goosh_push_errors_total",
+			Help: "Pushes that failed, by service and status code.",
+		}, []string{"service", "code"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "goosh_push_requests_total",
+			Help: "Requests to /push, by status code.",
+		}, []string{"code"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.pushLatency,
+		m.pushErrors,
+		m.requests,
+	)
+	return m
+}
+
+// instrument points the hooks of ps, when it has any, to the service's
+// metrics.
+func (m *metrics) instrument(service string, ps interface{}) {
+	i, ok := ps.(instrumentable)
+	if !ok {
+		return
+	}
+	latency := m.pushLatency.WithLabelValues(service)
+	i.SetInstrumentation(func(took time.Duration) {
+		latency.Observe(took.Seconds())
+	}, func(code int) {
+		m.pushErrors.WithLabelValues(service, strconv.Itoa(code)).Inc()
+	})
+}
+
+// watch exports the Stats of the push WorkerGroup.
+func (m *metrics) watch(wg *worker.WorkerGroup) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "goosh_workers_busy",
+			Help: "Workers currently running a push.",
+		}, func() float64 { return float64(wg.Stats().Busy) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "goosh_work_queue_length",
+			Help: "Pushes waiting for a free worker.",
+		}, func() float64 { return float64(wg.Stats().Queued) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "goosh_jobs_processed_total",
+			Help: "Pushes run by the workers.",
+		}, func() float64 { return float64(wg.Stats().Processed) }),
+	)
+}
+
+func (m *metrics) countRequests(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(m.requests, next)
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
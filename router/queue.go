@@ -0,0 +1,97 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"git.sr.ht/~mmf/queuer"
+	"github.com/michele/goosh"
+	"github.com/pkg/errors"
+)
+
+const defaultQueueConcurrency = 10
+
+// ServeQueue consumes the goosh.Requests published on in, as cli.Enqueue
+// does, sends them like /push would and publishes their responses on out,
+// where cli.Pop and cli.Receive read them. Both queues must already be
+// started. It stops consuming once ctx is done or in is closed, and returns
+// after the requests being processed are done: ctx doesn't cancel them.
+//
+// A message is acknowledged once its response is published. Messages whose
+// response couldn't be published, or whose push failed as a whole with a
+// retryable error, are left unacknowledged for the queue to deliver them
+// again. Malformed and invalid requests are never retried: the latter get a
+// failed response with a 422.
+func (s *Server) ServeQueue(ctx context.Context, in, out queuer.Queue) error {
+	n := s.QueueConcurrency
+	if n <= 0 {
+		n = 1
+	}
+	slots := make(chan bool, n)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	procFunc := s.dispatcher(s.APNS, s.FCM)
+	msgs := in.Receive()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case obj, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			select {
+			case slots <- true:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				s.consume(procFunc, obj, out)
+			}()
+		}
+	}
+}
+
+// consume processes a single queue message.
+func (s *Server) consume(procFunc processFunc, obj queuer.Object, out queuer.Queue) {
+	var req goosh.Request
+	err := json.Unmarshal(obj.Body(), &req)
+	if err != nil {
+		s.Log.Error("Dropping malformed queued push", "error", errors.Wrap(err, "couldn't unmarshal request"))
+		s.ack(obj)
+		return
+	}
+	var dr goosh.Response
+	if reason := s.unprocessable(req); reason != "" {
+		dr = rejection(req, 422, reason)
+	} else {
+		dr, err = procFunc(context.Background(), req)
+		if err != nil {
+			s.Log.Error("Couldn't process queued push", append(goosh.PushFields(req), "error", err, "status", errorStatus(dr))...)
+			if dr.Failed && dr.Error != nil && dr.Error.ShouldRetry {
+				return
+			}
+		}
+	}
+	body, err := json.Marshal(dr)
+	if err != nil {
+		s.Log.Error("Couldn't marshal queued push response", append(goosh.PushFields(req), "error", err)...)
+		return
+	}
+	err = out.Publish(body)
+	if err != nil {
+		s.Log.Error("Couldn't publish queued push response", append(goosh.PushFields(req), "error", err)...)
+		return
+	}
+	s.ack(obj)
+}
+
+func (s *Server) ack(obj queuer.Object) {
+	if err := obj.Done(); err != nil {
+		s.Log.Warn("Couldn't acknowledge queue message", "error", err)
+	}
+}
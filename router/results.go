@@ -0,0 +1,122 @@
+package router
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michele/goosh"
+)
+
+// ResultStore keeps the responses of recent async pushes, keyed by push ID,
+// so that they can be fetched from GET /push/{push_id}. It holds at most size
+// pushes, dropping the oldest first, each one for ttl.
+type ResultStore struct {
+	size    int
+	ttl     time.Duration
+	lock    sync.Mutex
+	results map[string]*list.Element
+	order   *list.List
+}
+
+type storedResult struct {
+	pushID   string
+	response *goosh.Response
+	expires  time.Time
+}
+
+func NewResultStore(size int, ttl time.Duration) *ResultStore {
+	return &ResultStore{
+		size:    size,
+		ttl:     ttl,
+		results: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Pending records that pushID is being processed.
+func (rs *ResultStore) Pending(pushID string) {
+	rs.store(pushID, nil)
+}
+
+// Put records the response to a processed push.
+func (rs *ResultStore) Put(pushID string, dr goosh.Response) {
+	rs.store(pushID, &dr)
+}
+
+// Get returns the response to pushID, nil while it's still being processed.
+// found is false for pushes that are unknown or expired.
+func (rs *ResultStore) Get(pushID string) (dr *goosh.Response, found bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	el, ok := rs.results[pushID]
+	if !ok {
+		return nil, false
+	}
+	res := el.Value.(*storedResult)
+	if time.Now().After(res.expires) {
+		rs.remove(el)
+		return nil, false
+	}
+	return res.response, true
+}
+
+func (rs *ResultStore) store(pushID string, dr *goosh.Response) {
+	if pushID == "" {
+		return
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if el, ok := rs.results[pushID]; ok {
+		rs.remove(el)
+	}
+	rs.evict(time.Now())
+	res := &storedResult{pushID: pushID, response: dr, expires: time.Now().Add(rs.ttl)}
+	rs.results[pushID] = rs.order.PushBack(res)
+}
+
+// evict drops the expired results and, while the store is full, the oldest
+// ones. Results are ordered by expiry since they all share the same ttl.
+func (rs *ResultStore) evict(now time.Time) {
+	for el := rs.order.Front(); el != nil; el = rs.order.Front() {
+		if rs.order.Len() < rs.size && now.Before(el.Value.(*storedResult).expires) {
+			return
+		}
+		rs.remove(el)
+	}
+}
+
+func (rs *ResultStore) remove(el *list.Element) {
+	rs.order.Remove(el)
+	delete(rs.results, el.Value.(*storedResult).pushID)
+}
+
+// resultHandler serves GET /push/{push_id}: the stored response, a 202 while
+// the push is being processed or a 404 for unknown pushes.
+func (s *Server) resultHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "", 405)
+			return
+		}
+		if s.Results == nil {
+			http.Error(w, "", 404)
+			return
+		}
+		dr, found := s.Results.Get(strings.TrimPrefix(r.URL.Path, "/push/"))
+		if !found {
+			http.Error(w, "", 404)
+			return
+		}
+		if dr == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dr)
+	})
+}
@@ -0,0 +1,255 @@
+package router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/michele/goosh"
+	"github.com/michele/goosh/worker"
+	"github.com/pkg/errors"
+)
+
+const defaultAsyncRetryBackoff = 30 * time.Second
+
+// PendingRetry is an async push reduced to the devices that were flagged
+// for retry, along with the callback its result should be delivered to.
+// Pushes waiting for another attempt also carry when it's due, its number
+// and the response of the previous attempts.
+type PendingRetry struct {
+	Request  goosh.Request   `json:"request"`
+	Callback string          `json:"callback,omitempty"`
+	RetryAt  *time.Time      `json:"retry_at,omitempty"`
+	Attempt  int             `json:"attempt,omitempty"`
+	Response *goosh.Response `json:"response,omitempty"`
+}
+
+// RetryStore persists PendingRetry values across restarts.
+type RetryStore interface {
+	Save([]PendingRetry) error
+	Load() ([]PendingRetry, error)
+}
+
+// FileRetryStore is a RetryStore keeping pending retries as JSON in a file.
+// The file holds the requests' credentials and is written with 0600
+// permissions.
+type FileRetryStore struct {
+	Path string
+}
+
+func (fs FileRetryStore) Save(retries []PendingRetry) error {
+	if retries == nil {
+		retries = []PendingRetry{}
+	}
+	body, err := json.Marshal(retries)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal pending retries")
+	}
+	// Write to a temporary file first so a crash mid-write doesn't
+	// truncate what was there before.
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.Path), filepath.Base(fs.Path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "couldn't create temporary retry file")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't write temporary retry file")
+	}
+	err = os.Rename(tmp.Name(), fs.Path)
+	if err != nil {
+		return errors.Wrap(err, "couldn't replace retry file")
+	}
+	return nil
+}
+
+func (fs FileRetryStore) Load() ([]PendingRetry, error) {
+	body, err := ioutil.ReadFile(fs.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read retry file")
+	}
+	var retries []PendingRetry
+	err = json.Unmarshal(body, &retries)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't unmarshal retry file")
+	}
+	return retries, nil
+}
+
+// FlushRetries hands the retries still scheduled to the RetryStore, and
+// cancels them. It's meant to be called during shutdown, once the workers
+// have drained. Pushes whose attempts ran out aren't kept: their result is
+// in the callback queue, which is drained afterwards.
+func (s *Server) FlushRetries() error {
+	if s.RetryStore == nil {
+		return nil
+	}
+	s.retryLock.Lock()
+	var pending []PendingRetry
+	for p := range s.scheduled {
+		pending = append(pending, *p)
+	}
+	s.scheduled = map[*PendingRetry]bool{}
+	s.retryLock.Unlock()
+	err := s.RetryStore.Save(pending)
+	if err != nil {
+		return errors.Wrap(err, "couldn't save pending retries")
+	}
+	return nil
+}
+
+// ResumeRetries loads the retries saved by a previous FlushRetries and
+// processes them again, delivering results to their callbacks. The ones
+// that were waiting for another attempt are scheduled for their RetryAt.
+func (s *Server) ResumeRetries() error {
+	if s.RetryStore == nil {
+		return nil
+	}
+	pending, err := s.RetryStore.Load()
+	if err != nil {
+		return errors.Wrap(err, "couldn't load pending retries")
+	}
+	err = s.RetryStore.Save(nil)
+	if err != nil {
+		return errors.Wrap(err, "couldn't clear pending retries")
+	}
+	for _, p := range pending {
+		req := p.Request
+		if req.Platform() == "" {
+			s.Log.Warn("Dropping pending retry: unknown platform", goosh.PushFields(req)...)
+			continue
+		}
+		if s.Results != nil {
+			s.Results.Pending(req.PushID)
+		}
+		procFunc := s.dispatcher(s.APNS, s.FCM)
+		if p.RetryAt != nil && s.CB != nil {
+			s.schedule(s.CB, procFunc, p)
+			continue
+		}
+		if p.Attempt < 1 {
+			p.Attempt = 1
+		}
+		p := p
+		s.goAsync(func() { s.attemptAsync(s.CB, procFunc, p) })
+	}
+	return nil
+}
+
+// scheduleRetry schedules another attempt for the retryable devices of dr,
+// the response to p, unless p was the last attempt allowed.
+func (s *Server) scheduleRetry(cb *worker.WorkerGroup, procFunc processFunc, p PendingRetry, dr goosh.Response) bool {
+	if cb == nil || p.Attempt >= s.AsyncMaxAttempts {
+		return false
+	}
+	devices := dr.Retryable()
+	if len(devices) == 0 {
+		return false
+	}
+	at := retryAt(dr, time.Now().Add(s.AsyncRetryBackoff))
+	s.schedule(cb, procFunc, PendingRetry{
+		Request:  p.Request.Subset(devices),
+		Callback: p.Callback,
+		RetryAt:  &at,
+		Attempt:  p.Attempt + 1,
+		Response: &dr,
+	})
+	return true
+}
+
+// schedule has cb attempt p again at its RetryAt. Until then p is kept for
+// FlushRetries, which also cancels the attempt.
+func (s *Server) schedule(cb *worker.WorkerGroup, procFunc processFunc, p PendingRetry) {
+	entry := &p
+	s.retryLock.Lock()
+	s.scheduled[entry] = true
+	s.retryLock.Unlock()
+	s.Log.Info("Scheduled push retry", append(goosh.PushFields(p.Request), "attempt", p.Attempt, "retry_at", p.RetryAt.Format(time.RFC3339))...)
+	cb.EnqueueAt(retryJob{s: s, cb: cb, procFunc: procFunc, entry: entry}, *p.RetryAt)
+}
+
+// retryJob starts a scheduled attempt, unless FlushRetries took it first.
+type retryJob struct {
+	s        *Server
+	cb       *worker.WorkerGroup
+	procFunc processFunc
+	entry    *PendingRetry
+}
+
+func (j retryJob) Work() bool {
+	j.s.retryLock.Lock()
+	defer j.s.retryLock.Unlock()
+	if !j.s.scheduled[j.entry] {
+		return true
+	}
+	// Attempts wait on the push workers, so they can't hold the callback
+	// worker. While shutting down the entry stays scheduled for
+	// FlushRetries.
+	if j.s.goAsync(func() { j.s.attemptAsync(j.cb, j.procFunc, *j.entry) }) {
+		delete(j.s.scheduled, j.entry)
+	}
+	return true
+}
+
+// retryAt is the latest RetryAt of the retryable devices of dr, so that
+// every platform backoff has expired by then, or fallback when none is
+// later.
+func retryAt(dr goosh.Response, fallback time.Time) time.Time {
+	at := fallback
+	for _, d := range dr.Devices {
+		if !d.ShouldRetry && (d.Error == nil || !d.Error.ShouldRetry) {
+			continue
+		}
+		if d.Error != nil && d.Error.RetryAt != nil && d.Error.RetryAt.After(at) {
+			at = *d.Error.RetryAt
+		}
+	}
+	return at
+}
+
+// mergeRetry replaces the devices of prev with their results in next, the
+// response of a retry, and recomputes the totals.
+func mergeRetry(prev, next goosh.Response) goosh.Response {
+	retried := map[string][]goosh.DeviceResponse{}
+	for _, d := range next.Devices {
+		retried[d.Identifier] = append(retried[d.Identifier], d)
+	}
+	merged := prev
+	merged.Devices = make([]goosh.DeviceResponse, 0, len(prev.Devices))
+	merged.Success, merged.Failure = 0, 0
+	merged.Unregistered = nil
+	merged.Failed = prev.Failed && next.Failed
+	if !merged.Failed {
+		merged.Error = nil
+	}
+	for _, d := range prev.Devices {
+		if r := retried[d.Identifier]; len(r) > 0 {
+			d = r[0]
+			retried[d.Identifier] = r[1:]
+		}
+		merged.Devices = append(merged.Devices, d)
+		if d.Delivered {
+			merged.Success++
+		} else {
+			merged.Failure++
+		}
+		if d.Unregistered {
+			merged.Unregistered = append(merged.Unregistered, d.Identifier)
+		}
+	}
+	if prev.Sections != nil {
+		merged.SummarizeSections()
+	}
+	return merged
+}
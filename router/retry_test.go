@@ -0,0 +1,89 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/michele/goosh"
+	"github.com/michele/goosh/worker"
+)
+
+type memoryRetryStore struct {
+	saved []PendingRetry
+	saves int
+}
+
+func (ms *memoryRetryStore) Save(retries []PendingRetry) error {
+	ms.saved = retries
+	ms.saves++
+	return nil
+}
+
+func (ms *memoryRetryStore) Load() ([]PendingRetry, error) {
+	return ms.saved, nil
+}
+
+// retryable answers every push with its devices flagged for retry.
+func retryable(ctx context.Context, req goosh.Request) (goosh.Response, error) {
+	dr := goosh.Response{PushID: req.PushID}
+	for _, d := range req.Multiplexed.Devices {
+		dr.Devices = append(dr.Devices, goosh.DeviceResponse{Identifier: d, ShouldRetry: true})
+		dr.Failure++
+	}
+	return dr, nil
+}
+
+func TestFlushRetriesOnlyKeepsOutstandingRetries(t *testing.T) {
+	var callbacks int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&callbacks, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	req := goosh.Request{
+		PushID:      "push",
+		FCMAuth:     &goosh.FCMAuth{AuthKey: "key"},
+		Multiplexed: &goosh.Multiplexed{Devices: []string{"device"}, Payload: json.RawMessage(`{}`)},
+	}
+
+	for _, attempts := range []int{1, 2} {
+		cb := worker.NewWorkerGroup(1)
+		cb.Start()
+		store := &memoryRetryStore{}
+		s := NewServer(func(s *Server) {
+			s.Logger = log.New(ioutil.Discard, "", 0)
+			s.CB = cb
+			s.RetryStore = store
+			s.AsyncMaxAttempts = attempts
+			s.AsyncRetryBackoff = time.Hour
+		})
+		atomic.StoreInt64(&callbacks, 0)
+		s.processAsync(cb, retryable, req, ts.URL)
+		cb.Stop()
+		if err := s.FlushRetries(); err != nil {
+			t.Fatal(err)
+		}
+		switch attempts {
+		case 1:
+			// The last attempt's result was delivered, nothing is left.
+			if callbacks != 1 || len(store.saved) != 0 {
+				t.Fatalf("with 1 attempt got %d callbacks and saved %+v, want 1 callback and nothing saved", callbacks, store.saved)
+			}
+		case 2:
+			if callbacks != 0 || len(store.saved) != 1 || store.saved[0].Attempt != 2 {
+				t.Fatalf("with 2 attempts got %d callbacks and saved %+v, want the second attempt saved", callbacks, store.saved)
+			}
+		}
+		// A second flush, as after a restart, has nothing left to save.
+		if err := s.FlushRetries(); err != nil || len(store.saved) != 0 {
+			t.Fatalf("the second flush saved %+v, %v", store.saved, err)
+		}
+	}
+}
@@ -2,22 +2,40 @@ package router
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/michele/factotum"
 	"github.com/michele/goosh"
+	"github.com/michele/goosh/worker"
 	"github.com/pkg/errors"
 )
 
 const defaultCallbackTimeout = 30
 
+const (
+	defaultCallbackMaxRetries     = 10
+	defaultCallbackInitialBackoff = 5 * time.Second
+)
+
+const (
+	defaultMaxJSONDepth = 64
+	defaultMaxJSONKeys  = 1 << 20
+	defaultMaxBodyBytes = 4 << 20
+	defaultMaxDevices   = 10000
+	defaultMaxInFlight  = 1000
+)
+
 var callbackTimeout = defaultCallbackTimeout
 
 func init() {
@@ -32,134 +50,680 @@ func init() {
 }
 
 type Server struct {
-	Logger    *log.Logger
-	mux       *http.ServeMux
-	APNS      goosh.PushService
-	FCM       goosh.PushService
-	CB        *factotum.WorkerGroup
-	GoingAway bool
+	Logger *log.Logger
+	mux    *http.ServeMux
+	APNS   goosh.PushService
+	FCM    goosh.PushService
+	CB     *worker.WorkerGroup
+	// Workers, when set, is the WorkerGroup the push services enqueue to.
+	Workers *worker.WorkerGroup
+	// MaxInFlight bounds the pushes being processed, async ones included.
+	// Pushes over it are refused with a 503. Zero or less disables the
+	// limit.
+	MaxInFlight int
+	// ReadinessTimeout is how long MaxInFlight pushes may stay in flight,
+	// or Workers busy without finishing any job, before /readyz reports a
+	// 503.
+	ReadinessTimeout time.Duration
+	// Log receives the structured logs, it defaults to JSON lines written
+	// to Logger.
+	Log goosh.Logger
+	// MaxJSONDepth and MaxJSONKeys bound the nesting depth and the total
+	// number of object keys of a /push body. Bodies over either limit are
+	// rejected with a 400 before being unmarshaled.
+	MaxJSONDepth int
+	MaxJSONKeys  int
+	// MaxBodyBytes bounds the size of a /push body, larger ones get a 413.
+	// MaxDevices bounds the number of devices a single push can target,
+	// larger ones get a 422. Limits lower than or equal to zero are ignored.
+	MaxBodyBytes int64
+	MaxDevices   int64
+	// AuthToken and AuthSecret, when set, protect /push with a bearer token
+	// and an HMAC-SHA256 signature of the body respectively. See withAuth.
+	AuthToken  string
+	AuthSecret string
+	// CallbackSecret, when set, signs callback POSTs. See signCallback.
+	CallbackSecret string
+	// CallbackMaxRetries is how many times a callback is attempted. The wait
+	// between attempts starts at CallbackInitialBackoff and doubles, up to
+	// CallbackMaxBackoff when that's greater than zero. The Retry-After of a
+	// 429 is waited for instead, also up to CallbackMaxBackoff.
+	CallbackMaxRetries     int
+	CallbackInitialBackoff time.Duration
+	CallbackMaxBackoff     time.Duration
+	// InstrumentCallback, when set, is called once a callback is delivered
+	// or gives up, with the number of attempts and the time they took.
+	InstrumentCallback func(success bool, attempts int, took time.Duration)
+	// OnCertExpiring, when set, is handed to the APNS service to be told
+	// about certificates close to their expiry. See
+	// apns2.PushService.OnCertExpiring.
+	OnCertExpiring func(topic string, expiry time.Time)
+	// Results, when set, keeps the responses of async pushes for GET
+	// /push/{push_id}. Pushes can then be sent with ?async=true rather
+	// than a callback.
+	Results *ResultStore
+	// AsyncMaxAttempts is how many times an async push may be attempted
+	// before its result is delivered. The devices flagged for retry are
+	// sent again through CB's delay queue at the latest RetryAt among them,
+	// or AsyncRetryBackoff after the attempt when they have none. One or
+	// less never retries.
+	AsyncMaxAttempts  int
+	AsyncRetryBackoff time.Duration
+	// QueueConcurrency is how many queued pushes ServeQueue processes at
+	// once.
+	QueueConcurrency int
+	// RetryStore, when set, receives the async pushes waiting for another
+	// attempt so they survive a restart. See FlushRetries.
+	RetryStore RetryStore
+	retryLock  sync.Mutex
+	scheduled  map[*PendingRetry]bool
+	metrics    *metrics
+	ready      readiness
+	// async counts the async attempts running, see WaitAsync. No attempt
+	// starts once draining is set.
+	asyncLock sync.Mutex
+	async     sync.WaitGroup
+	draining  bool
+	// inFlight counts the pushes admitted and not done yet.
+	inFlight int32
+	// goingAway is set by SetGoingAway, see GoingAway.
+	goingAway int32
 }
 
 func NewServer(options ...func(*Server)) *Server {
 	s := &Server{
-		Logger: log.New(os.Stdout, "", 0),
-		mux:    http.NewServeMux(),
+		Logger:       log.New(os.Stdout, "", 0),
+		mux:          http.NewServeMux(),
+		MaxJSONDepth: defaultMaxJSONDepth,
+		MaxJSONKeys:  defaultMaxJSONKeys,
+		MaxBodyBytes: defaultMaxBodyBytes,
+		MaxDevices:   defaultMaxDevices,
+		MaxInFlight:  defaultMaxInFlight,
+		metrics:      newMetrics(),
+
+		CallbackMaxRetries:     defaultCallbackMaxRetries,
+		CallbackInitialBackoff: defaultCallbackInitialBackoff,
+		ReadinessTimeout:       defaultReadinessTimeout,
+
+		AsyncMaxAttempts:  1,
+		AsyncRetryBackoff: defaultAsyncRetryBackoff,
+		QueueConcurrency:  defaultQueueConcurrency,
+		scheduled:         map[*PendingRetry]bool{},
 	}
 
 	for _, f := range options {
 		f(s)
 	}
+	if s.Log == nil {
+		s.Log = goosh.NewLogger(s.Logger, goosh.LevelInfo)
+	}
 
-	s.mux.HandleFunc("/healtz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); fmt.Fprintf(w, "OK") })
-	s.mux.Handle("/push", s.pushHandler(s.CB, s.APNS, s.FCM))
+	s.mux.Handle("/healtz", s.withMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); fmt.Fprintf(w, "OK") })))
+	s.metrics.instrument(goosh.ServiceAPNS, s.APNS)
+	s.metrics.instrument(goosh.ServiceFCM, s.FCM)
+	if w, ok := s.APNS.(certWatcher); ok && s.OnCertExpiring != nil {
+		w.SetCertExpiryHook(s.OnCertExpiring)
+	}
+	if s.Workers != nil {
+		s.metrics.watch(s.Workers)
+	}
+	s.mux.Handle("/push", s.withMetrics(s.limitBody(s.withStreamingAuth(s.metrics.countRequests(s.pushHandler(s.CB, s.APNS, s.FCM))))))
+	s.mux.Handle("/readyz", s.withMetrics(s.readyHandler()))
+	s.mux.Handle("/version", s.withMetrics(versionHandler()))
+	s.mux.Handle("/metrics", s.metrics.handler())
+	s.mux.Handle("/push/", s.withMetrics(s.withAuth(s.resultHandler())))
 
 	return s
 }
 
+// WithCallbackInstrumentation reports every callback delivery to f.
+func WithCallbackInstrumentation(f func(success bool, attempts int, took time.Duration)) func(*Server) {
+	return func(s *Server) {
+		s.InstrumentCallback = f
+	}
+}
+
+// WithCertExpiryHook has f called for APNS certificates about to expire.
+func WithCertExpiryHook(f func(topic string, expiry time.Time)) func(*Server) {
+	return func(s *Server) {
+		s.OnCertExpiring = f
+	}
+}
+
+// certWatcher is implemented by push services able to warn about expiring
+// certificates, see apns2.PushService.
+type certWatcher interface {
+	SetCertExpiryHook(func(topic string, expiry time.Time))
+}
+
+// WithDispatcher serves the push services and the workers of d.
+func WithDispatcher(d *goosh.Dispatcher) func(*Server) {
+	return func(s *Server) {
+		s.APNS = d.APNS
+		s.FCM = d.FCM
+		s.Workers = d.Workers
+	}
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
-func (s *Server) pushHandler(cb *factotum.WorkerGroup, apns goosh.PushService, fcm goosh.PushService) http.Handler {
+func (s *Server) pushHandler(cb *worker.WorkerGroup, apns goosh.PushService, fcm goosh.PushService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.GoingAway {
+		if s.GoingAway() {
 			w.WriteHeader(503)
 			return
 		}
-		var req goosh.Request
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			err = errors.Wrap(err, "Couldn't read body")
-			log.Printf("%+v\nThis was the request: %+v", err, r)
-			http.Error(w, "", 500)
+		if !s.admit() {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			return
+		}
+		// Async pushes are done when their attempt is.
+		admitted := true
+		defer func() {
+			if admitted {
+				s.done()
+			}
+		}()
+		body := &errReader{r: r.Body}
+		req, err := decodeRequest(body, &jsonBudget{maxDepth: s.MaxJSONDepth, maxKeys: s.MaxJSONKeys})
+		if bodyTooLarge(body.err) {
+			rejectPush(w, req, 413, fmt.Sprintf("BodyTooLarge: at most %d bytes are allowed", s.MaxBodyBytes))
+			return
+		}
+		if body.err != nil {
+			s.Log.Error("Couldn't read body", "error", body.err, "remote", r.RemoteAddr, "content_length", r.ContentLength)
+			rejectPush(w, req, 500, "UnreadableBody")
+			return
+		}
+		if !signed(r) {
+			unauthorized(w)
+			return
+		}
+		if _, ok := err.(complexityError); ok {
+			s.Log.Warn("Rejecting body", "error", err, "remote", r.RemoteAddr, "status", 400)
+			rejectPush(w, req, 400, "BodyTooComplex: "+err.Error())
 			return
 		}
-		err = json.Unmarshal(body, &req)
 		if err != nil {
-			err = errors.Wrap(err, "Couldn't unmarshal body into request")
-			log.Printf("%+v\nThis was the body: %s", err, string(body))
-			http.Error(w, "", 400)
+			s.Log.Warn("Couldn't unmarshal body into request", "error", err, "remote", r.RemoteAddr, "content_length", r.ContentLength, "status", 400)
+			rejectPush(w, req, 400, "InvalidJSON: "+err.Error())
 			return
 		}
+		if id := r.Header.Get(requestIDHeader); id != "" {
+			req.TraceID = id
+		}
+		if req.TraceID != "" {
+			w.Header().Set(requestIDHeader, req.TraceID)
+		}
 		var dr goosh.Response
 		callbackURL := r.URL.Query().Get("callback")
-		var procFunc func(goosh.Request) (goosh.Response, error)
-		if req.IsFCM() {
-			procFunc = fcm.Process
-		} else if req.IsAPNS() {
-			procFunc = apns.Process
-		} else {
-			http.Error(w, "", 422)
+		async := callbackURL != "" || (s.Results != nil && r.URL.Query().Get("async") == "true")
+		if reason := s.unprocessable(req); reason != "" {
+			rejectPush(w, req, 422, reason)
+			return
+		}
+		if !async && acceptsNDJSON(r) {
+			s.streamPush(r.Context(), w, apns, fcm, req)
 			return
 		}
-		if callbackURL != "" {
-			go func() {
-				dr, _ = procFunc(req)
-				cb.Enqueue(callback{response: dr, url: callbackURL})
-			}()
+		procFunc := s.dispatcher(apns, fcm)
+		if async {
+			if s.Results != nil {
+				s.Results.Pending(req.PushID)
+			}
+			attempt := func() {
+				defer s.done()
+				s.processAsync(cb, procFunc, req, callbackURL)
+			}
+			if !s.goAsync(attempt) {
+				if s.Results != nil {
+					s.Results.Put(req.PushID, rejection(req, 503, "ShuttingDown"))
+				}
+				rejectPush(w, req, 503, "ShuttingDown")
+				return
+			}
+			admitted = false
 			w.WriteHeader(http.StatusAccepted)
 		} else {
-			dr, _ = procFunc(req)
+			dr, err = procFunc(r.Context(), req)
+			if r.Context().Err() != nil {
+				// The client is gone, so the devices left were canceled and
+				// nobody reads the response. It can still be fetched from
+				// /push/{push_id} when results are kept.
+				s.Log.Warn("Client went away during push", append(goosh.PushFields(req), "success", dr.Success, "failure", dr.Failure)...)
+				if s.Results != nil && req.PushID != "" {
+					s.Results.Put(req.PushID, dr)
+				}
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
+			if err != nil {
+				s.Log.Error("Couldn't process push", append(goosh.PushFields(req), "error", err, "status", errorStatus(dr))...)
+				w.WriteHeader(errorStatus(dr))
+			}
 			json.NewEncoder(w).Encode(dr)
 		}
 	})
 }
 
+// streamPush answers with a line of NDJSON for every DeviceResponse, written
+// as soon as it's known. The last line is the Response, without its
+// devices.
+func (s *Server) streamPush(ctx context.Context, w http.ResponseWriter, apns goosh.PushService, fcm goosh.PushService, req goosh.Request) {
+	w.Header().Set("Content-Type", ndjson)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	stream := make(chan goosh.DeviceResponse, 10)
+	var dr goosh.Response
+	var err error
+	go func() {
+		defer close(stream)
+		dr, err = s.streamingDispatcher(apns, fcm, stream)(ctx, req)
+	}()
+	for d := range stream {
+		enc.Encode(d)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err != nil {
+		s.Log.Error("Couldn't process push", append(goosh.PushFields(req), "error", err)...)
+	}
+	// Services that can't stream, or that failed before sending anything,
+	// still collect their devices.
+	for _, d := range dr.Devices {
+		enc.Encode(d)
+	}
+	dr.Devices = nil
+	enc.Encode(dr)
+}
+
+const ndjson = "application/x-ndjson"
+
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]) == ndjson {
+			return true
+		}
+	}
+	return false
+}
+
+// SetGoingAway tells whether the server is shutting down. While it is, new
+// pushes are refused with a 503 and /readyz reports it.
+func (s *Server) SetGoingAway(goingAway bool) {
+	var v int32
+	if goingAway {
+		v = 1
+	}
+	atomic.StoreInt32(&s.goingAway, v)
+}
+
+// GoingAway tells whether the server is shutting down, see SetGoingAway.
+func (s *Server) GoingAway() bool {
+	return atomic.LoadInt32(&s.goingAway) == 1
+}
+
+// admit counts a push in flight, unless MaxInFlight already are.
+func (s *Server) admit() bool {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	if s.MaxInFlight > 0 && int(n) > s.MaxInFlight {
+		s.done()
+		return false
+	}
+	return true
+}
+
+// done counts a push admitted by admit as no longer in flight.
+func (s *Server) done() {
+	atomic.AddInt32(&s.inFlight, -1)
+}
+
+// saturated tells whether MaxInFlight pushes are in flight.
+func (s *Server) saturated() bool {
+	return s.MaxInFlight > 0 && int(atomic.LoadInt32(&s.inFlight)) >= s.MaxInFlight
+}
+
+// goAsync runs f, an async attempt, in a goroutine WaitAsync waits for.
+// It returns false without running f once WaitAsync was called.
+func (s *Server) goAsync(f func()) bool {
+	s.asyncLock.Lock()
+	defer s.asyncLock.Unlock()
+	if s.draining {
+		return false
+	}
+	s.async.Add(1)
+	go func() {
+		defer s.async.Done()
+		f()
+	}()
+	return true
+}
+
+// WaitAsync stops starting async attempts and waits for the running ones
+// to finish, so that their callbacks are enqueued and their retries
+// scheduled before the workers are stopped. Scheduled retries that come
+// due afterwards are left for FlushRetries. It returns ctx's error when
+// ctx is done first.
+func (s *Server) WaitAsync(ctx context.Context) error {
+	s.asyncLock.Lock()
+	s.draining = true
+	s.asyncLock.Unlock()
+	done := make(chan bool)
+	go func() {
+		s.async.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) processAsync(cb *worker.WorkerGroup, procFunc processFunc, req goosh.Request, callbackURL string) {
+	s.attemptAsync(cb, procFunc, PendingRetry{Request: req, Callback: callbackURL, Attempt: 1})
+}
+
+// attemptAsync sends p, scheduling another attempt for its retryable
+// devices when it can have one and delivering the result otherwise.
+func (s *Server) attemptAsync(cb *worker.WorkerGroup, procFunc processFunc, p PendingRetry) {
+	req := p.Request
+	// The client is gone as soon as the push is accepted, so its context
+	// isn't a reason to stop.
+	dr, err := procFunc(context.Background(), req)
+	if err != nil {
+		s.Log.Error("Couldn't process push", append(goosh.PushFields(req), "error", err)...)
+	}
+	if p.Response != nil {
+		dr = mergeRetry(*p.Response, dr)
+	}
+	if s.scheduleRetry(cb, procFunc, p, dr) {
+		return
+	}
+	if s.Results != nil {
+		s.Results.Put(req.PushID, dr)
+	}
+	if p.Callback == "" {
+		return
+	}
+	cb.Enqueue(callback{
+		response:       dr,
+		url:            p.Callback,
+		secret:         s.CallbackSecret,
+		maxRetries:     s.CallbackMaxRetries,
+		initialBackoff: s.CallbackInitialBackoff,
+		maxBackoff:     s.CallbackMaxBackoff,
+		log:            s.Log,
+		instrument:     s.InstrumentCallback,
+	})
+}
+
+type processFunc func(context.Context, goosh.Request) (goosh.Response, error)
+
+// dispatcher returns a process function sending requests through a
+// goosh.Dispatcher over apns and fcm.
+func (s *Server) dispatcher(apns goosh.PushService, fcm goosh.PushService) processFunc {
+	return s.streamingDispatcher(apns, fcm, nil)
+}
+
+// streamingDispatcher is dispatcher sending the DeviceResponses to stream,
+// rather than collecting them, through the services that support it.
+func (s *Server) streamingDispatcher(apns goosh.PushService, fcm goosh.PushService, stream chan<- goosh.DeviceResponse) processFunc {
+	d := &goosh.Dispatcher{APNS: apns, FCM: fcm, Workers: s.Workers, Log: s.Log}
+	return func(ctx context.Context, req goosh.Request) (goosh.Response, error) {
+		return d.SendStream(ctx, req, stream)
+	}
+}
+
+// requestIDHeader carries the TraceID of pushes and of their callbacks.
+const requestIDHeader = "X-Request-Id"
+
+// limitBody caps the bodies of the requests to MaxBodyBytes.
+func (s *Server) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyTooLarge tells whether err comes from reading past the limit of a
+// body wrapped by limitBody.
+func bodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// jsonBudget bounds the nesting depth and the total number of object keys
+// of a body checked one value at a time. Limits lower than or equal to zero
+// are ignored.
+type jsonBudget struct {
+	maxDepth int
+	maxKeys  int
+	keys     int
+}
+
+// complexityError is returned when a body goes over its jsonBudget.
+type complexityError struct {
+	error
+}
+
+// countKey accounts for an object key read outside of check.
+func (b *jsonBudget) countKey() error {
+	b.keys++
+	if b.maxKeys > 0 && b.keys > b.maxKeys {
+		return complexityError{errors.Errorf("body has more than %d keys", b.maxKeys)}
+	}
+	return nil
+}
+
+// check walks body, found depth levels deep in the document, token by token
+// and fails as soon as the nesting depth exceeds maxDepth or more than
+// maxKeys object keys are seen overall.
+func (b *jsonBudget) check(body []byte, depth int) error {
+	type frame struct {
+		object  bool
+		wantKey bool
+	}
+	var stack []frame
+	valueDone := func() {
+		if n := len(stack); n > 0 && stack[n-1].object {
+			stack[n-1].wantKey = true
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "couldn't tokenize body")
+		}
+		if d, ok := tok.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				if b.maxDepth > 0 && depth+len(stack) >= b.maxDepth {
+					return complexityError{errors.Errorf("body is nested deeper than %d levels", b.maxDepth)}
+				}
+				stack = append(stack, frame{object: d == '{', wantKey: d == '{'})
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+			continue
+		}
+		if n := len(stack); n > 0 && stack[n-1].wantKey {
+			if err := b.countKey(); err != nil {
+				return err
+			}
+			stack[n-1].wantKey = false
+			continue
+		}
+		valueDone()
+	}
+}
+
+// rejectPush answers with a failed Response whose Error explains why req
+// can't be processed.
+func rejectPush(w http.ResponseWriter, req goosh.Request, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rejection(req, code, description))
+}
+
+// rejection is the response to a push refused before being processed.
+func rejection(req goosh.Request, code int, description string) goosh.Response {
+	return goosh.Response{
+		Failed:   true,
+		Error:    &goosh.Error{Code: int64(code), Description: description},
+		Devices:  []goosh.DeviceResponse{},
+		PushID:   req.PushID,
+		CustomID: req.CustomID,
+		Service:  req.Platform(),
+		TraceID:  req.TraceID,
+	}
+}
+
+// unprocessable tells why req can't be processed, when it's invalid or
+// targets more than MaxDevices devices.
+func (s *Server) unprocessable(req goosh.Request) string {
+	if err := req.Validate(); err != nil {
+		return "InvalidRequest: " + strings.Join(err.(*goosh.ValidationError).Problems, "; ")
+	}
+	apnsReq, fcmReq := req.Split()
+	var n int64
+	if apnsReq != nil {
+		n += apnsReq.Count()
+	}
+	if fcmReq != nil {
+		n += fcmReq.Count()
+	}
+	if s.MaxDevices > 0 && n > s.MaxDevices {
+		return fmt.Sprintf("TooManyDevices: the push targets %d devices, at most %d are allowed", n, s.MaxDevices)
+	}
+	return ""
+}
+
+// errorStatus picks the HTTP status for a response whose processing failed,
+// using the request-level error code when it's a valid client or server
+// error status.
+func errorStatus(dr goosh.Response) int {
+	if dr.Error != nil && dr.Error.Code >= 400 && dr.Error.Code < 600 {
+		return int(dr.Error.Code)
+	}
+	return 500
+}
+
 type callback struct {
-	url      string
-	response goosh.Response
+	url            string
+	response       goosh.Response
+	secret         string
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	log            goosh.Logger
+	instrument     func(success bool, attempts int, took time.Duration)
 }
 
 func (c callback) Work() bool {
 	sent := false
+	delivered := false
 	try := 0
-	wait := 5
+	began := time.Now()
+	wait := c.initialBackoff
 	cli := http.Client{
 		Timeout: time.Duration(callbackTimeout) * time.Second,
 	}
-	for sent == false && try < 10 {
+	if c.instrument != nil {
+		defer func() {
+			c.instrument(delivered, try, time.Since(began))
+		}()
+	}
+	// Retrying wouldn't fix the response or the URL.
+	body, err := json.Marshal(c.response)
+	if err != nil {
+		c.log.Error("Couldn't marshal response", "error", err, "push_id", c.response.PushID)
+		return true
+	}
+	for sent == false && try < c.maxRetries {
 		try++
-		body, err := json.Marshal(c.response)
-		if err != nil {
-			err = errors.Wrap(err, "couldn't marshal response")
-			log.Printf("Couldn't marshal response: %+v\nThis was the response: %+v", err, c.response)
-			continue
-		}
+		var retryAfter time.Duration
 		creq, err := http.NewRequest("POST", c.url, ioutil.NopCloser(bytes.NewBuffer(body)))
 		if err != nil {
-			err = errors.Wrap(err, "couldn't build HTTP request")
-			log.Printf("Couldn't build request: %+v\nURL: %s\nThis was the response: %+v", err, c.url, c.response)
-			continue
+			c.log.Error("Couldn't build callback request", "error", err, "push_id", c.response.PushID, "url", c.url)
+			return true
+		}
+		if c.response.TraceID != "" {
+			creq.Header.Set(requestIDHeader, c.response.TraceID)
 		}
+		if c.secret != "" {
+			signCallback(creq, c.response.PushID, body, c.secret, time.Now())
+		}
+		fields := []interface{}{"push_id", c.response.PushID, "url", c.url, "try", try}
 		cres, err := cli.Do(creq)
+		if err == nil {
+			cres.Body.Close()
+		}
 		if err != nil {
-			err = errors.Wrap(err, "couldn't trigger callback")
-			log.Printf("Couldn't call callback: %+v\nThis was the body: %s", err, string(body))
+			c.log.Warn("Couldn't call callback", append(fields, "error", err)...)
+		} else if cres.StatusCode == http.StatusTooManyRequests {
+			c.log.Warn("Callback is rate limiting", append(fields, "status", cres.StatusCode)...)
+			retryAfter = parseRetryAfter(cres.Header.Get("Retry-After"), time.Now())
+			if c.maxBackoff > 0 && retryAfter > c.maxBackoff {
+				retryAfter = c.maxBackoff
+			}
 		} else if cres.StatusCode >= 500 {
-			err = errors.New("got error calling callback")
-			log.Printf("Error calling callback: %+v\nThis was the body: %s", cres, string(body))
+			c.log.Warn("Error calling callback", append(fields, "status", cres.StatusCode)...)
 		} else if cres.StatusCode >= 400 {
-			err = errors.New("something's not right with callback")
-			log.Printf("Got a 4XX from callback: %+v\nThis was the body: %s", cres, string(body))
+			c.log.Error("Callback refused the response", append(fields, "status", cres.StatusCode)...)
 			sent = true
 		} else {
 			sent = true
+			delivered = true
 		}
-		if sent {
+		if sent || try >= c.maxRetries {
 			break
 		}
 
-		time.Sleep(time.Duration(wait) * time.Second)
+		if retryAfter > 0 {
+			time.Sleep(retryAfter)
+		} else {
+			time.Sleep(wait)
+		}
 		wait = wait * 2
+		if c.maxBackoff > 0 && wait > c.maxBackoff {
+			wait = c.maxBackoff
+		}
 	}
 	return true
 }
 
-func (s *Server) withMetrics(l *log.Logger, next http.Handler) http.Handler {
+// parseRetryAfter reads a Retry-After header, given either in seconds or as
+// an HTTP date. It returns zero when the header is missing or malformed.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// withMetrics logs the duration of every request.
+func (s *Server) withMetrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		began := time.Now()
 		next.ServeHTTP(w, r)
-		l.Printf("%s %s took %s", r.Method, r.URL, time.Since(began))
+		s.Log.Info("Handled request", "method", r.Method, "path", r.URL.Path, "took", time.Since(began))
 	})
 }
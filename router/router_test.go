@@ -0,0 +1,121 @@
+package router
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michele/goosh"
+)
+
+// blockingService answers pushes once release is closed, telling started
+// about each of them.
+type blockingService struct {
+	started chan bool
+	release chan bool
+}
+
+func (bs *blockingService) Process(r goosh.Request) (goosh.Response, error) {
+	return bs.ProcessContext(context.Background(), r)
+}
+
+func (bs *blockingService) ProcessContext(ctx context.Context, r goosh.Request) (goosh.Response, error) {
+	bs.started <- true
+	<-bs.release
+	return goosh.Response{Service: goosh.ServiceFCM, Success: r.Count()}, nil
+}
+
+const fcmPush = `{"fcm":{"auth_key":"key"},"multiplexed":{"devices":["device"],"payload":{"data":{"a":"b"}}}}`
+
+func push(s *Server) int {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/push", strings.NewReader(fcmPush)))
+	return w.Code
+}
+
+func TestMaxInFlight(t *testing.T) {
+	bs := &blockingService{started: make(chan bool, 1), release: make(chan bool)}
+	s := NewServer(func(s *Server) {
+		s.Logger = log.New(ioutil.Discard, "", 0)
+		s.FCM = bs
+		s.MaxInFlight = 1
+	})
+	codes := make(chan int)
+	go func() { codes <- push(s) }()
+	<-bs.started
+
+	if code := push(s); code != http.StatusServiceUnavailable {
+		t.Fatalf("a push over MaxInFlight got a %d, want a 503", code)
+	}
+	now := time.Now()
+	if reason := s.checkReadiness(now); reason != "" {
+		t.Fatalf("not ready as soon as saturated: %s", reason)
+	}
+	if reason := s.checkReadiness(now.Add(s.ReadinessTimeout + time.Second)); reason == "" {
+		t.Fatal("ready while saturated for longer than ReadinessTimeout")
+	}
+
+	close(bs.release)
+	if code := <-codes; code != http.StatusOK {
+		t.Fatalf("the admitted push got a %d, want a 200", code)
+	}
+	if reason := s.checkReadiness(time.Now()); reason != "" {
+		t.Fatalf("not ready once the push is done: %s", reason)
+	}
+	if code := push(s); code != http.StatusOK {
+		t.Fatalf("a push after the admitted one got a %d, want a 200", code)
+	}
+}
+
+func TestGoingAwayDuringPushes(t *testing.T) {
+	s := NewServer(func(s *Server) {
+		s.Logger = log.New(ioutil.Discard, "", 0)
+		s.FCM = &countingService{}
+	})
+	stop := make(chan bool)
+	flipped := make(chan bool)
+	go func() {
+		defer close(flipped)
+		for away := true; ; away = !away {
+			select {
+			case <-stop:
+				return
+			default:
+				s.SetGoingAway(away)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if code := push(s); code != 200 && code != 503 {
+					t.Errorf("got a %d, want a 200 or a 503", code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-flipped
+
+	s.SetGoingAway(true)
+	if code := push(s); code != 503 {
+		t.Fatalf("got a %d while going away, want a 503", code)
+	}
+	if reason := s.checkReadiness(time.Now()); reason != "going away" {
+		t.Fatalf("readiness is %q while going away", reason)
+	}
+	s.SetGoingAway(false)
+	if code := push(s); code != 200 {
+		t.Fatalf("got a %d once no longer going away, want a 200", code)
+	}
+}
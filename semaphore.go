@@ -0,0 +1,37 @@
+package goosh
+
+import "context"
+
+// Semaphore bounds how many pushes of a request are queued or running at
+// once, so that a large request leaves workers to the others. A nil
+// Semaphore never blocks.
+type Semaphore chan struct{}
+
+// NewSemaphore returns a Semaphore of n slots, or nil when n isn't
+// positive.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire waits for a free slot, failing when ctx is done first.
+func (s Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot taken by Acquire.
+func (s Semaphore) Release() {
+	if s != nil {
+		<-s
+	}
+}
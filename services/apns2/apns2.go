@@ -2,6 +2,7 @@ package apns2
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/md5"
 	"crypto/tls"
@@ -14,44 +15,211 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/michele/factotum"
 	"github.com/michele/goosh"
+	"github.com/michele/goosh/worker"
 	"github.com/pkg/errors"
 	"golang.org/x/net/http2"
 )
 
 var (
-	ErrFailedToDecryptKey           = errors.New("failed to decrypt private key")
-	ErrFailedToParsePKCS1PrivateKey = errors.New("failed to parse PKCS1 private key")
-	ErrFailedToParseCertificate     = errors.New("failed to parse certificate PEM data")
-	ErrNoPrivateKey                 = errors.New("no private key")
-	ErrNoCertificate                = errors.New("no certificate")
+	ErrFailedToDecryptKey       = errors.New("failed to decrypt private key")
+	ErrFailedToParsePrivateKey  = errors.New("failed to parse private key")
+	ErrFailedToParseCertificate = errors.New("failed to parse certificate PEM data")
+	ErrNoPrivateKey             = errors.New("no private key")
+	ErrNoCertificate            = errors.New("no certificate")
+	// Deprecated: keys aren't only parsed as PKCS#1 anymore, use
+	// ErrFailedToParsePrivateKey.
+	ErrFailedToParsePKCS1PrivateKey = ErrFailedToParsePrivateKey
 )
 
+const (
+	productionHost  = "api.push.apple.com"
+	developmentHost = "api.development.push.apple.com"
+)
+
+// alternatePort is the port APNS also listens on, for networks blocking
+// outbound connections to 443.
+const alternatePort = "2197"
+
+// maxPayloadSize is the largest payload, in bytes, APNS accepts. VoIP pushes
+// get up to maxVoIPPayloadSize.
+const (
+	maxPayloadSize     = 4096
+	maxVoIPPayloadSize = 5120
+)
+
+// maxCollapseIDSize is the longest apns-collapse-id, in bytes, APNS accepts.
+const maxCollapseIDSize = 64
+
+const (
+	defaultPushType    = "alert"
+	backgroundType     = "background"
+	highPriority       = 10
+	backgroundPriority = 5
+)
+
+const (
+	defaultPingInterval = 60 * time.Second
+	defaultPingTimeout  = 15 * time.Second
+)
+
+const defaultClientTTL = time.Hour
+
+const defaultCertExpiryWindow = 14 * 24 * time.Hour
+
+const defaultMaxStreams = 100
+
+const (
+	defaultMaxRetries          = 5
+	defaultRetryBackoff        = 500 * time.Millisecond
+	defaultRetryAfterOnFailure = 300 * time.Second
+)
+
+// defaultHost is the APNS host override read from GOOSH_APNS_HOST. It's empty
+// unless the variable is set to a valid host (optionally with a port).
+var defaultHost string
+
+var envErr error
+
+func init() {
+	if h := os.Getenv("GOOSH_APNS_HOST"); len(h) > 0 {
+		if validHost(h) {
+			defaultHost = h
+		} else {
+			envErr = errors.Errorf("invalid GOOSH_APNS_HOST %q", h)
+		}
+	}
+}
+
+// EnvError returns why GOOSH_APNS_HOST couldn't be used, if it's set to
+// something that isn't a host. PushServices then send to Apple's hosts.
+func EnvError() error {
+	return envErr
+}
+
 type PushService struct {
-	clients         map[string]client
+	clients         map[string]*cachedClient
 	lock            sync.Mutex
-	queue           chan factotum.WorkRequest
+	queue           chan worker.WorkRequest
 	Instrument      bool
 	InstrumentPush  func(time.Duration)
 	InstrumentError func(int)
 	Logger          *log.Logger
+	// Log, when set, receives the structured logs instead of Logger.
+	Log goosh.Logger
+	// PayloadFilter restricts the top-level payload keys sent to APNS. A
+	// nil filter forwards payloads untouched.
+	PayloadFilter *goosh.PayloadFilter
+	// DefaultPayload is deep-merged under every push's payload, so values
+	// set by the caller win over it.
+	DefaultPayload json.RawMessage
+	// Host overrides both the production and the development APNS hosts
+	// when set. NewPushService initializes it from GOOSH_APNS_HOST, so a
+	// value assigned after construction takes precedence over the
+	// environment, which in turn takes precedence over Apple's hosts.
+	Host string
+	// PingInterval is how long a connection may stay idle before it's
+	// health-checked with an HTTP/2 PING, keeping it warm between bursts. A
+	// connection that doesn't answer within PingTimeout is closed. Zero
+	// disables the pings. Changes only apply to clients created afterwards.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// TransportErrorDetails appends the underlying Go error to the
+	// description of connection-level failures.
+	TransportErrorDetails bool
+	// MaxRetries is how many times a push is sent again after failing to
+	// reach APNS, waiting RetryBackoff before the first retry and twice as
+	// long before each of the following ones. RetryAfterOnFailure is how
+	// far in the future RetryAt is set when APNS couldn't take the push.
+	MaxRetries          int
+	RetryBackoff        time.Duration
+	RetryAfterOnFailure time.Duration
+	// ClientTTL is how long a cached client may go unused before it's
+	// evicted and its connections closed. MaxClients, when positive, caps
+	// the cache size, evicting the least recently used clients first. Clients
+	// in use by a push are never evicted.
+	ClientTTL  time.Duration
+	MaxClients int
+	// MaxStreams caps how many pushes may be in flight on the connection of
+	// a single client, so that one big request neither hogs the workers nor
+	// opens more streams than APNS allows. Zero removes the cap. Changes
+	// only apply to clients created afterwards.
+	MaxStreams int
+	// RatePerSecond, when positive, limits the pushes sent with every
+	// certificate or auth key, allowing bursts of Burst pushes. Pushes wait
+	// for their turn before being queued, and are reported as canceled when
+	// their request's deadline would pass first. Changes only apply before
+	// the first push.
+	RatePerSecond float64
+	Burst         int
+	limiter       *goosh.RateLimiter
+	// MaxRequestConcurrency, when positive, caps how many pushes of a
+	// single request may be queued or running at once, so that a large
+	// request can't take all the workers. Zero removes the cap.
+	MaxRequestConcurrency int
+	// AlternatePort connects to Apple's hosts on port 2197 rather than 443.
+	// It doesn't apply to Host. Changes only apply to clients created
+	// afterwards.
+	AlternatePort bool
+	// RootCAs, when set, replaces the system roots when verifying the APNS
+	// server, so that Host can point at a mock APNS with its own
+	// certificate. Changes only apply to clients created afterwards.
+	RootCAs *x509.CertPool
+	// CertRoots, when set, is the pool certificates must chain up to, such
+	// as one holding Apple's root CA, so that wrong uploads are refused
+	// before connecting. Certificates signed by other roots fail with
+	// UntrustedCert.
+	CertRoots *x509.CertPool
+	// Proxy picks the proxy the connections to APNS go through, none when
+	// it returns nil. NewPushService sets it to http.ProxyFromEnvironment,
+	// which reads HTTPS_PROXY and NO_PROXY. Changes only apply to clients
+	// created afterwards.
+	Proxy func(*http.Request) (*url.URL, error)
+	// OnCertExpiring, when set, is called once for every certificate that
+	// expires within CertExpiryWindow, as soon as a client is built with
+	// it. The certificates are told apart by their cache key. A zero
+	// CertExpiryWindow turns the warnings off.
+	OnCertExpiring   func(topic string, expiry time.Time)
+	CertExpiryWindow time.Duration
+	expiringCerts    map[string]bool
+	// Workers, when set, is the group reading the queue. Requests then
+	// register with it while fanning out, so that stopping it waits for
+	// their devices to be queued rather than dropping them.
+	Workers *worker.WorkerGroup
+}
+
+// cachedClient is an entry of the client cache. inUse counts the pushes
+// currently holding the client. ready is closed once cli is built, or err
+// tells why it couldn't be.
+type cachedClient struct {
+	cli      client
+	lastUsed time.Time
+	inUse    int
+	ready    chan struct{}
+	err      error
 }
 
 type client struct {
 	http         *http.Client
+	hostOverride string
 	cacheKey     string
 	production   bool
 	pemData      []byte
 	certificates tls.Certificate
 	topic        string
+	token        *tokenSigner
+	// streams holds a token for every push in flight, when MaxStreams is
+	// set.
+	streams       chan struct{}
+	alternatePort bool
 }
 type push struct {
 	pushID    string
@@ -61,25 +229,72 @@ type push struct {
 }
 
 type workRequest struct {
-	msg goosh.Message
-	res chan<- goosh.DeviceResponse
-	cli *client
-	ps  *PushService
+	ctx   context.Context
+	msg   goosh.Message
+	res   chan<- goosh.DeviceResponse
+	cli   *client
+	ps    *PushService
+	slots goosh.Semaphore
 }
 
 type response struct {
 	Reason string `json:"reason"`
+	// Timestamp is when APNS learned the token was no longer valid, in
+	// milliseconds since the epoch. It's only sent along with a 410.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// unregistered tells whether an APNS failure means the token is gone for good
+// and should be removed rather than retried. Only a 410 says so: a 400
+// BadDeviceToken is also sent for tokens pushed to the wrong environment.
+func unregistered(status int, reason string) bool {
+	return status == 410 && (reason == "Unregistered" || reason == "BadDeviceToken")
+}
+
+func (ps *PushService) log() goosh.Logger {
+	if ps.Log != nil {
+		return ps.Log
+	}
+	return goosh.NewLogger(ps.Logger, goosh.LevelInfo)
 }
 
-func NewPushService(q chan factotum.WorkRequest) (ps *PushService) {
+func NewPushService(q chan worker.WorkRequest) (ps *PushService) {
 	ps = &PushService{}
-	ps.clients = map[string]client{}
+	ps.clients = map[string]*cachedClient{}
 	ps.queue = q
 	ps.Logger = log.New(os.Stdout, "", 0)
+	ps.Host = defaultHost
+	ps.PingInterval = defaultPingInterval
+	ps.PingTimeout = defaultPingTimeout
+	ps.MaxRetries = defaultMaxRetries
+	ps.RetryBackoff = defaultRetryBackoff
+	ps.RetryAfterOnFailure = defaultRetryAfterOnFailure
+	ps.ClientTTL = defaultClientTTL
+	ps.MaxStreams = defaultMaxStreams
+	ps.CertExpiryWindow = defaultCertExpiryWindow
+	ps.expiringCerts = map[string]bool{}
+	ps.Proxy = http.ProxyFromEnvironment
 	return ps
 }
 
+func validHost(h string) bool {
+	u, err := url.Parse("https://" + h)
+	if err != nil {
+		return false
+	}
+	return u.Host == h && u.Hostname() != ""
+}
+
 func cacheKey(r goosh.Request) (string, error) {
+	if r.APNSAuth.UsesToken() {
+		key := []byte(r.APNSAuth.AuthKey + r.APNSAuth.KeyID + r.APNSAuth.TeamID)
+		if r.APNSAuth.Sandbox {
+			key = append(key, []byte("true")...)
+		} else {
+			key = append(key, []byte("false")...)
+		}
+		return GetMD5Hash(key), nil
+	}
 	key, err := base64.StdEncoding.DecodeString(r.APNSAuth.Certificate)
 	if err != nil {
 		err = errors.Wrap(err, "couldn't decode apns certificate")
@@ -102,20 +317,20 @@ var dialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
 	return tls.DialWithDialer(dialer, network, addr, cfg)
 }
 
-func newClient(ck string, r goosh.Request) (cli client, err error) {
-	pemData, err := base64.StdEncoding.DecodeString(r.APNSAuth.Certificate)
+func (ps *PushService) newClient(ck string, r goosh.Request) (cli client, err error) {
+	cli.hostOverride = ps.Host
+	if r.APNSAuth.UsesToken() {
+		return ps.newTokenClient(r)
+	}
+	certData, err := base64.StdEncoding.DecodeString(r.APNSAuth.Certificate)
 	if err != nil {
 		err = errors.Wrap(err, "couldn't decode apns certificate")
 		return
 	}
-	//if !sandbox {
-	rxp := regexp.MustCompile(`(?mi)^\s*friendlyName: [^:]+ Push Services: (.*)$`)
-	ss := rxp.FindSubmatch(pemData)
-	if len(ss) > 0 {
-		cli.topic = string(ss[1])
+	pemData, err := certificatePEM(certData, r.APNSAuth.CertificatePassword, r.APNSAuth.CertificateFormat)
+	if err != nil {
+		return
 	}
-	//}
-
 	cli.pemData = pemData
 
 	if r.APNSAuth.Sandbox {
@@ -129,6 +344,22 @@ func newClient(ck string, r goosh.Request) (cli client, err error) {
 		err = errors.Wrap(err, "couldn't parse PEM certificate")
 		return
 	}
+	cli.topic = certificateTopic(certs.Leaf, pemData)
+	err = checkValidity(certs, time.Now())
+	if err != nil {
+		err = errors.Wrap(err, "invalid APNS certificate")
+		return
+	}
+	if ps.CertRoots != nil {
+		err = VerifyChain(certs, ps.CertRoots)
+		if err != nil {
+			err = errors.Wrap(err, "untrusted APNS certificate")
+			return
+		}
+	}
+	if certs.Leaf != nil {
+		ps.checkExpiry(ck, cli.topic, certs.Leaf.NotAfter)
+	}
 
 	conf := &tls.Config{
 		Certificates: []tls.Certificate{certs},
@@ -137,10 +368,7 @@ func newClient(ck string, r goosh.Request) (cli client, err error) {
 	if len(certs.Certificate) > 0 {
 		conf.BuildNameToCertificate()
 	}
-	transport := &http2.Transport{
-		TLSClientConfig: conf,
-		DialTLS:         dialTLS,
-	}
+	transport := ps.newTransport(conf)
 
 	hcli := &http.Client{
 		Transport: transport,
@@ -153,71 +381,190 @@ func newClient(ck string, r goosh.Request) (cli client, err error) {
 	return
 }
 
+func (ps *PushService) newTransport(conf *tls.Config) *http2.Transport {
+	if ps.RootCAs != nil {
+		conf.RootCAs = ps.RootCAs
+	}
+	return &http2.Transport{
+		TLSClientConfig: conf,
+		DialTLS:         ps.dial,
+		ReadIdleTimeout: ps.PingInterval,
+		PingTimeout:     ps.PingTimeout,
+	}
+}
+
+func (ps *PushService) newTokenClient(r goosh.Request) (cli client, err error) {
+	cli.hostOverride = ps.Host
+	cli.production = !r.APNSAuth.Sandbox
+	cli.token, err = newTokenSigner(r.APNSAuth.AuthKey, r.APNSAuth.KeyID, r.APNSAuth.TeamID)
+	if err != nil {
+		err = errors.Wrap(err, "couldn't parse APNS auth key")
+		return
+	}
+	transport := ps.newTransport(&tls.Config{})
+	cli.http = &http.Client{
+		Transport: transport,
+		Timeout:   60 * time.Second,
+	}
+	return
+}
+
 func (c *client) host() string {
+	if c.hostOverride != "" {
+		return c.hostOverride
+	}
+	host := developmentHost
 	if c.production {
-		return "api.push.apple.com"
+		host = productionHost
 	}
-	return "api.development.push.apple.com"
+	if c.alternatePort {
+		return host + ":" + alternatePort
+	}
+	return host
 }
 
 func (c *client) urlForDevice(device string) string {
 	return "https://" + c.host() + "/3/device/" + device
 }
 
-func (c *client) Push(m goosh.Message, ps *PushService) (goosh.DeviceResponse, error) {
-	body, _ := json.Marshal(m.Payload)
+func (c *client) Push(ctx context.Context, m goosh.Message, ps *PushService) (goosh.DeviceResponse, error) {
 	device := m.Token
 	dres := goosh.DeviceResponse{}
 	dres.Identifier = device
-	uid := uuid.New().String()
-	req, err := http.NewRequest("POST", c.urlForDevice(device), ioutil.NopCloser(bytes.NewBuffer([]byte(body))))
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Apns-Id", uid)
-	if c.topic != "" {
-		req.Header.Add("Apns-Topic", c.topic)
+	dres.Section = m.Section
+	payload, err := goosh.MergePayload(ps.DefaultPayload, m.Payload)
+	if err != nil {
+		err = errors.Wrap(err, "couldn't merge default payload")
+		dres.Error = &goosh.Error{Code: 422, Description: "(pre-validation) invalid payload"}
+		return dres, err
 	}
-
+	payload, err = ps.PayloadFilter.Apply(payload)
+	if err != nil {
+		err = errors.Wrap(err, "payload rejected by filter")
+		dres.Error = &goosh.Error{Code: 422, Description: "(pre-validation) " + errors.Cause(err).Error()}
+		return dres, err
+	}
+	pushType, priority, err := pushHeaders(m)
+	if err != nil {
+		dres.Error = &goosh.Error{Code: 400, Description: "(pre-validation) " + err.Error()}
+		return dres, err
+	}
+	err = checkPayload(payload, pushType)
+	if err != nil {
+		dres.Error = &goosh.Error{Code: 422, Description: "(pre-validation) " + err.Error()}
+		return dres, err
+	}
+	if m.Broadcast != "" {
+		err = errors.New("APNS doesn't support broadcasts")
+		dres.Error = &goosh.Error{Code: 400, Description: "(pre-validation) " + err.Error()}
+		return dres, err
+	}
+	if len(m.CollapseID) > maxCollapseIDSize {
+		err = errors.Errorf("collapse ID longer than %d bytes", maxCollapseIDSize)
+		dres.Error = &goosh.Error{Code: 400, Description: "(pre-validation) " + err.Error()}
+		return dres, err
+	}
+	body, _ := json.Marshal(payload)
+	if limit := payloadLimit(pushType); len(body) > limit {
+		err = errors.Errorf("payload of %d bytes is over the %d bytes limit", len(body), limit)
+		dres.Error = &goosh.Error{Code: 413, Description: "(pre-validation) payload too large"}
+		return dres, err
+	}
+	uid := m.APNSID
+	if uid == "" {
+		uid = uuid.New().String()
+	} else if _, err := uuid.Parse(uid); err != nil {
+		err = errors.Wrap(err, "invalid apns-id")
+		dres.Error = &goosh.Error{Code: 400, Description: "(pre-validation) invalid apns-id"}
+		return dres, err
+	}
+	dres.APNSID = uid
+	req, err := http.NewRequestWithContext(ctx, "POST", c.urlForDevice(device), ioutil.NopCloser(bytes.NewBuffer([]byte(body))))
 	if err != nil {
 		err = errors.Wrap(err, "error building APNS request")
-		ps.Logger.Printf("Error building request: %+v", err)
+		ps.log().Error("Couldn't build APNS request", "error", err, "service", goosh.ServiceAPNS)
 		dres.Error = &goosh.Error{Description: "error building APNS request"}
 		return dres, err
 	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Apns-Id", uid)
+	req.Header.Add("Apns-Push-Type", pushType)
+	req.Header.Add("Apns-Priority", strconv.Itoa(priority))
+	topic := m.Topic
+	if topic == "" {
+		topic = derivedTopic(c.topic, pushType)
+	}
+	if topic != "" {
+		req.Header.Add("Apns-Topic", topic)
+	}
+	if !m.Expiration.IsZero() {
+		req.Header.Add("Apns-Expiration", strconv.FormatInt(m.Expiration.Unix(), 10))
+	}
+	if m.CollapseID != "" {
+		req.Header.Add("Apns-Collapse-Id", m.CollapseID)
+	}
+	if c.token != nil {
+		bearer, err := c.token.Bearer()
+		if err != nil {
+			err = errors.Wrap(err, "couldn't sign APNS provider token")
+			ps.log().Error("Couldn't sign provider token", "error", err, "service", goosh.ServiceAPNS)
+			dres.Error = &goosh.Error{Code: 422, Description: "couldn't sign APNS provider token"}
+			return dres, err
+		}
+		req.Header.Add("Authorization", "bearer "+bearer)
+	}
 	//resp, err := client.Post(, "application/json", )
 	not_sent := true
-	retries := 5
+	retries := ps.MaxRetries
+	backoff := ps.RetryBackoff
 	start := time.Now()
 	var resp *http.Response
 	for not_sent {
 		resp, err = c.http.Do(req)
+		if err != nil && ctx.Err() != nil {
+			return goosh.CanceledResponse(m, ctx.Err()), errors.Wrap(err, "push canceled")
+		}
 		if err != nil {
 			ps.instrumentError(599)
 			err = errors.Wrap(err, "couldn't make request to APNS")
-			ps.Logger.Printf("Couldn't contact APNS (tries left: %d): %+v", retries, err)
+			ps.log().Warn("Couldn't contact APNS", "error", err, "service", goosh.ServiceAPNS, "tries_left", retries)
 			if retries <= 0 {
-				wait := time.Now().Add(300 * time.Second)
-				dres.Error = &goosh.Error{ShouldRetry: true, RetryAt: &wait, Code: 502, Description: "couldn't make request to APNS"}
+				wait := time.Now().Add(ps.RetryAfterOnFailure)
+				kind, desc := classifyTransportError(err)
+				if ps.TransportErrorDetails {
+					desc += ": " + errors.Cause(err).Error()
+				}
+				dres.Error = &goosh.Error{ShouldRetry: true, RetryAt: &wait, Code: 502, Kind: kind, Description: desc}
 				return dres, err
 			}
 			retries--
 			req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(body)))
-			time.Sleep(500 * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				return goosh.CanceledResponse(m, ctx.Err()), errors.Wrap(ctx.Err(), "push canceled")
+			case <-time.After(backoff):
+			}
+			backoff *= 2
 		} else {
 			not_sent = false
 		}
 	}
 	defer resp.Body.Close()
+	if id := resp.Header.Get("Apns-Id"); id != "" {
+		dres.APNSID = id
+	}
 
 	if resp.StatusCode == 200 {
 		ioutil.ReadAll(resp.Body)
 		dres.Delivered = true
+		dres.SetTiming(start)
 	} else {
 		ps.instrumentError(resp.StatusCode)
 		apnsError := goosh.Error{Code: int64(resp.StatusCode)}
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			err = errors.Wrap(err, "couldn't read APNS response")
-			ps.Logger.Printf("Couldn't read response: %+v", err)
+			ps.log().Warn("Couldn't read APNS response", "error", err, "service", goosh.ServiceAPNS)
 			apnsError.Description = "couldn't read APNS response"
 			dres.Error = &apnsError
 			return dres, err
@@ -226,15 +573,25 @@ func (c *client) Push(m goosh.Message, ps *PushService) (goosh.DeviceResponse, e
 		err = json.Unmarshal(body, &parsedErr)
 		if err != nil {
 			err = errors.Wrap(err, "couldn't parse APNS response")
-			ps.Logger.Printf("Couldn't parse response: %+v", err)
+			ps.log().Warn("Couldn't parse APNS response", "error", err, "service", goosh.ServiceAPNS)
 			apnsError.Description = "couldn't parse APNS response"
 			dres.Error = &apnsError
 			return dres, err
 		}
 		apnsError.Description = parsedErr.Reason
-		if resp.StatusCode >= 500 {
+		if unregistered(resp.StatusCode, parsedErr.Reason) {
+			dres.Unregistered = true
+			if parsedErr.Timestamp > 0 {
+				at := time.Unix(0, parsedErr.Timestamp*int64(time.Millisecond))
+				dres.UnregisteredAt = &at
+			}
+		}
+		if c.token != nil && parsedErr.Reason == "ExpiredProviderToken" {
+			c.token.Reset()
+		}
+		if resp.StatusCode >= 500 && !dres.Unregistered {
 			apnsError.ShouldRetry = true
-			wait := time.Now().Add(300 * time.Second)
+			wait := time.Now().Add(ps.RetryAfterOnFailure)
 			apnsError.RetryAt = &wait
 		}
 		dres.Error = &apnsError
@@ -245,106 +602,423 @@ func (c *client) Push(m goosh.Message, ps *PushService) (goosh.DeviceResponse, e
 	return dres, nil
 }
 
+// topicSuffixes are appended to the bundle ID to get the topic of push
+// types that have one of their own.
+var topicSuffixes = map[string]string{
+	"voip":         ".voip",
+	"complication": ".complication",
+	"fileprovider": ".pushkit.fileprovider",
+	"location":     ".location-query",
+	"liveactivity": ".push-type.liveactivity",
+}
+
+// derivedTopic is the topic of a push of the given type for the bundle ID
+// found in a certificate.
+func derivedTopic(bundleID, pushType string) string {
+	suffix := topicSuffixes[pushType]
+	if bundleID == "" || strings.HasSuffix(bundleID, suffix) {
+		return bundleID
+	}
+	return bundleID + suffix
+}
+
+// pushHeaders resolves the apns-push-type and apns-priority of a message,
+// applying the defaults and rejecting combinations APNS doesn't accept.
+func pushHeaders(m goosh.Message) (string, int, error) {
+	pushType := m.PushType
+	if pushType == "" {
+		pushType = defaultPushType
+	}
+	priority := m.Priority
+	if priority == 0 {
+		priority = highPriority
+		if pushType == backgroundType {
+			priority = backgroundPriority
+		}
+	}
+	if priority != 1 && priority != backgroundPriority && priority != highPriority {
+		return "", 0, errors.Errorf("invalid priority %d", priority)
+	}
+	if pushType == backgroundType && priority != backgroundPriority {
+		return "", 0, errors.Errorf("background pushes must use priority %d", backgroundPriority)
+	}
+	return pushType, priority, nil
+}
+
+// payloadLimit is the largest payload APNS accepts for pushType.
+func payloadLimit(pushType string) int {
+	if pushType == "voip" {
+		return maxVoIPPayloadSize
+	}
+	return maxPayloadSize
+}
+
+// checkPayload makes sure payload is a JSON object with an aps dictionary.
+// Background and VoIP pushes may leave aps out, their payload being only
+// meant for the app.
+func checkPayload(payload json.RawMessage, pushType string) error {
+	var parsed map[string]json.RawMessage
+	err := json.Unmarshal(payload, &parsed)
+	if err != nil || parsed == nil {
+		return errors.New("payload isn't a JSON object")
+	}
+	aps, ok := parsed["aps"]
+	if !ok {
+		if pushType == backgroundType || pushType == "voip" {
+			return nil
+		}
+		return errors.New("payload has no aps dictionary")
+	}
+	var dict map[string]json.RawMessage
+	if json.Unmarshal(aps, &dict) != nil || dict == nil {
+		return errors.New("aps isn't a dictionary")
+	}
+	return nil
+}
+
 func (wr workRequest) Work() bool {
-	dr, err := wr.cli.Push(wr.msg, wr.ps)
+	defer wr.cli.release()
+	defer wr.slots.Release()
+	if err := wr.ctx.Err(); err != nil {
+		wr.res <- goosh.CanceledResponse(wr.msg, err)
+		return true
+	}
+	dr, err := wr.cli.Push(wr.ctx, wr.msg, wr.ps)
 	wr.res <- dr
 	if err != nil {
-		log.Printf("Got an error sending push: %+v", err)
+		fields := []interface{}{"error", err, "service", goosh.ServiceAPNS}
+		if dr.Error != nil {
+			fields = append(fields, "status", dr.Error.Code)
+		}
+		wr.ps.log().Debug("Couldn't send push", fields...)
 		return false
 	}
 	return true
 }
 
-func (ps *PushService) getClient(r goosh.Request) (cli client, err error) {
-	var ok bool
-	var ck string
+// send queues wr, through Workers when it's set.
+func (ps *PushService) send(ctx context.Context, wr workRequest) error {
+	if ps.Workers != nil {
+		return ps.Workers.Send(ctx, wr)
+	}
+	select {
+	case ps.queue <- wr:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquire waits for a free stream of the client, failing when ctx is done
+// first.
+func (c *client) acquire(ctx context.Context) error {
+	if c.streams == nil {
+		return nil
+	}
+	select {
+	case c.streams <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the stream taken by acquire.
+func (c *client) release() {
+	if c.streams != nil {
+		<-c.streams
+	}
+}
+
+// limit waits for the rate limiter to allow another push with key.
+func (ps *PushService) limit(ctx context.Context, key string) error {
 	ps.lock.Lock()
-	defer ps.lock.Unlock()
-	ck, err = cacheKey(r)
+	if ps.limiter == nil && ps.RatePerSecond > 0 {
+		ps.limiter = goosh.NewRateLimiter(ps.RatePerSecond, ps.Burst)
+	}
+	l := ps.limiter
+	ps.lock.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Wait(ctx, key)
+}
+
+// getClient returns the cached client for the request's credentials,
+// creating it when needed. The client can't be evicted until release is
+// called. Clients are built without holding ps.lock, and only once for
+// concurrent requests with the same credentials.
+func (ps *PushService) getClient(r goosh.Request) (cli client, release func(), err error) {
+	ck, err := cacheKey(r)
 	if err != nil {
 		err = errors.Wrap(err, "Couldn't get cacheKey")
 		return
 	}
-	cli, ok = ps.clients[ck]
+	ps.lock.Lock()
+	cc, ok := ps.clients[ck]
 	if !ok {
-		cli, err = newClient(ck, r)
-		if err != nil {
-			err = errors.Wrap(err, "Couldn't setup new client")
+		cc = &cachedClient{ready: make(chan struct{})}
+		ps.clients[ck] = cc
+	}
+	// Holding the entry keeps it from being evicted while it's built.
+	cc.inUse++
+	ps.lock.Unlock()
+	if ok {
+		<-cc.ready
+	} else {
+		ps.buildClient(cc, ck, r)
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if cc.err != nil {
+		cc.inUse--
+		err = cc.err
+		return
+	}
+	cc.lastUsed = time.Now()
+	ps.evictClients()
+	release = func() {
+		ps.lock.Lock()
+		cc.inUse--
+		cc.lastUsed = time.Now()
+		ps.lock.Unlock()
+	}
+	return cc.cli, release, nil
+}
+
+// buildClient builds the client of cc, removing cc from the cache when
+// that fails so that the next request tries again.
+func (ps *PushService) buildClient(cc *cachedClient, ck string, r goosh.Request) {
+	cli, err := ps.newClient(ck, r)
+	if err == nil {
+		if ps.MaxStreams > 0 {
+			cli.streams = make(chan struct{}, ps.MaxStreams)
+		}
+		cli.cacheKey = ck
+		cli.alternatePort = ps.AlternatePort
+	}
+	ps.lock.Lock()
+	if err != nil {
+		cc.err = errors.Wrap(err, "Couldn't setup new client")
+		if ps.clients[ck] == cc {
+			delete(ps.clients, ck)
+		}
+	}
+	cc.cli = cli
+	ps.lock.Unlock()
+	close(cc.ready)
+}
+
+// evictClients drops the idle clients older than ClientTTL and, when there
+// are more than MaxClients, the least recently used idle ones. It must be
+// called with ps.lock held.
+func (ps *PushService) evictClients() {
+	now := time.Now()
+	for ck, cc := range ps.clients {
+		if cc.inUse == 0 && ps.ClientTTL > 0 && now.Sub(cc.lastUsed) > ps.ClientTTL {
+			ps.evictClient(ck)
+		}
+	}
+	for ps.MaxClients > 0 && len(ps.clients) > ps.MaxClients {
+		var oldest string
+		for ck, cc := range ps.clients {
+			if cc.inUse == 0 && (oldest == "" || cc.lastUsed.Before(ps.clients[oldest].lastUsed)) {
+				oldest = ck
+			}
+		}
+		if oldest == "" {
 			return
 		}
-		ps.clients[ck] = cli
+		ps.evictClient(oldest)
 	}
-	return
 }
 
-func (ps *PushService) Process(r goosh.Request) (resp goosh.Response, err error) {
+func (ps *PushService) evictClient(ck string) {
+	cc := ps.clients[ck]
+	delete(ps.clients, ck)
+	if t, ok := cc.cli.http.Transport.(*http2.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+func (ps *PushService) Process(r goosh.Request) (goosh.Response, error) {
+	return ps.ProcessContext(context.Background(), r)
+}
+
+func (ps *PushService) ProcessContext(ctx context.Context, r goosh.Request) (goosh.Response, error) {
+	return ps.process(ctx, r, nil)
+}
+
+func (ps *PushService) ProcessStream(ctx context.Context, r goosh.Request, devices chan<- goosh.DeviceResponse) (goosh.Response, error) {
+	return ps.process(ctx, r, devices)
+}
+
+// process sends r, collecting the DeviceResponses in the returned Response
+// unless stream is set, in which case they're sent there.
+func (ps *PushService) process(ctx context.Context, r goosh.Request, stream chan<- goosh.DeviceResponse) (resp goosh.Response, err error) {
 	if r.Count() <= 0 {
 		return
 	}
-	var cli client
-	cli, err = ps.getClient(r)
+	ctx, cancel := r.WithTimeout(ctx)
+	defer cancel()
+	if r.DryRun {
+		err = errors.New("APNS doesn't support dry runs")
+		resp = goosh.FailedResponse(r, goosh.ServiceAPNS, &goosh.Error{
+			ShouldRetry: false,
+			Code:        422,
+			Description: "DryRunUnsupported",
+		})
+		return
+	}
+	cli, release, err := ps.getClient(r)
 	resp.CustomID = r.CustomID
-	resp.Service = "apns"
+	resp.Service = goosh.ServiceAPNS
 	if err != nil {
-		// TODO: Setup response with error
-		err = errors.Wrap(err, "Couldn't get client")
-		resp.PushID = r.PushID
-		resp.Failed = true
-		resp.Failure = r.Count()
-		resp.Error = &goosh.Error{
+		resp = goosh.FailedResponse(r, goosh.ServiceAPNS, &goosh.Error{
 			ShouldRetry: false,
-			Code:        422,
-			Description: "InvalidCert",
-		}
-		resp.Devices = []goosh.DeviceResponse{}
-		for r.Next() {
-			resp.Devices = append(resp.Devices, goosh.DeviceResponse{Identifier: r.Value().Token})
-		}
-		ps.Logger.Printf("Error getting client: %+v", err)
+			Code:        401,
+			Description: invalidAuthReason(r, err) + ": " + errors.Cause(err).Error(),
+		})
+		err = errors.Wrap(err, "Couldn't get client")
+		ps.log().Error("Couldn't get APNS client", "error", err, "service", goosh.ServiceAPNS, "push_id", r.PushID, "devices", r.Count())
+		return
+	}
+	defer release()
+	if ps.Workers != nil && !ps.Workers.AddProducer() {
+		err = errors.New("the APNS workers are stopping")
+		resp = goosh.FailedResponse(r, goosh.ServiceAPNS, &goosh.Error{
+			ShouldRetry: true,
+			Code:        503,
+			Description: "ShuttingDown",
+		})
 		return
 	}
 	results := make(chan goosh.DeviceResponse, 10)
 	left := r.Count()
+	msgs := r.Messages()
+	slots := goosh.NewSemaphore(ps.MaxRequestConcurrency)
 	go func() {
-		for r.Next() {
+		if ps.Workers != nil {
+			defer ps.Workers.ProducerDone()
+		}
+		for msg := range msgs {
+			if err := ps.limit(ctx, cli.cacheKey); err != nil {
+				results <- goosh.CanceledResponse(msg, err)
+				continue
+			}
+			if err := slots.Acquire(ctx); err != nil {
+				results <- goosh.CanceledResponse(msg, err)
+				continue
+			}
+			if err := cli.acquire(ctx); err != nil {
+				slots.Release()
+				results <- goosh.CanceledResponse(msg, err)
+				continue
+			}
 			wr := workRequest{
-				msg: r.Value(),
-				cli: &cli,
-				res: results,
-				ps:  ps,
+				ctx:   ctx,
+				msg:   msg,
+				cli:   &cli,
+				res:   results,
+				ps:    ps,
+				slots: slots,
+			}
+			if err := ps.send(ctx, wr); err != nil {
+				cli.release()
+				slots.Release()
+				results <- goosh.CanceledResponse(msg, err)
 			}
-			ps.queue <- wr
 		}
 	}()
 
-	resps := []goosh.DeviceResponse{}
-	var success int64
-	var failed int64
+	resp = goosh.Response{
+		Devices:  []goosh.DeviceResponse{},
+		PushID:   r.PushID,
+		CustomID: r.CustomID,
+		Service:  goosh.ServiceAPNS,
+	}
 	for ; left > 0; left-- {
 		select {
 		case dr, ok := <-results:
 			if !ok {
 				left = 0
 			}
-			resps = append(resps, dr)
 			if dr.Delivered {
-				success++
+				resp.Success++
 			} else {
-				failed++
+				resp.Failure++
+			}
+			if dr.Unregistered {
+				resp.Unregistered = append(resp.Unregistered, dr.Identifier)
 			}
+			if stream == nil {
+				resp.Devices = append(resp.Devices, dr)
+				continue
+			}
+			if r.SplitSections {
+				resp.CountSection(dr)
+			}
+			stream <- dr
 		}
 	}
-	resp = goosh.Response{
-		Devices:  resps,
-		PushID:   r.PushID,
-		Success:  success,
-		Failure:  failed,
-		CustomID: r.CustomID,
-		Service:  "apns",
+	if stream == nil {
+		resp.SortDevices(r)
+	}
+	if stream == nil && r.SplitSections {
+		resp.SummarizeSections()
 	}
 	return
 }
 
+func invalidAuthReason(r goosh.Request, err error) string {
+	if r.APNSAuth.UsesToken() {
+		return "InvalidAuthKey"
+	}
+	if ve, ok := errors.Cause(err).(CertificateValidityError); ok {
+		if ve.Expired {
+			return "ExpiredCert"
+		}
+		return "CertNotYetValid"
+	}
+	if _, ok := errors.Cause(err).(CertificateChainError); ok {
+		return "UntrustedCert"
+	}
+	return "InvalidCert"
+}
+
+// SetInstrumentation turns instrumentation on, reporting to the given
+// hooks.
+func (ps *PushService) SetInstrumentation(push func(time.Duration), errs func(int)) {
+	ps.InstrumentPush = push
+	ps.InstrumentError = errs
+	ps.Instrument = true
+}
+
+// SetCertExpiryHook has f called for certificates about to expire, see
+// OnCertExpiring.
+func (ps *PushService) SetCertExpiryHook(f func(topic string, expiry time.Time)) {
+	ps.OnCertExpiring = f
+}
+
+// checkExpiry warns, once per cache key, about a certificate expiring
+// within CertExpiryWindow.
+func (ps *PushService) checkExpiry(ck, topic string, expiry time.Time) {
+	if time.Until(expiry) > ps.CertExpiryWindow {
+		return
+	}
+	ps.lock.Lock()
+	warned := ps.expiringCerts[ck]
+	ps.expiringCerts[ck] = true
+	ps.lock.Unlock()
+	if warned {
+		return
+	}
+	ps.log().Warn("APNS certificate expires soon", "topic", topic, "expiry", expiry)
+	if ps.OnCertExpiring != nil {
+		ps.OnCertExpiring(topic, expiry)
+	}
+}
+
 func (ps *PushService) instrumentError(code int) {
 	if ps.Instrument && ps.InstrumentError != nil {
 		ps.InstrumentError(code)
@@ -367,7 +1041,8 @@ func GetMD5Hash(text []byte) string {
 // returns a tls.Certificate. This function is similar to the crypto/tls
 // X509KeyPair function, however it supports PEM files with the cert and
 // key combined, as well as password protected keys which are both common with
-// APNs certificates.
+// APNs certificates. Chains are reordered so that the leaf comes first,
+// followed by its intermediates, whatever their order in the file.
 //
 // Use "" as the password argument if the PEM certificate is not password
 // protected.
@@ -396,6 +1071,7 @@ func FromPemBytes(bytes []byte, password string) (tls.Certificate, error) {
 	if cert.PrivateKey == nil {
 		return tls.Certificate{}, ErrNoPrivateKey
 	}
+	orderChain(&cert)
 	if c, e := x509.ParseCertificate(cert.Certificate[0]); e == nil {
 		cert.Leaf = c
 	}
@@ -403,6 +1079,10 @@ func FromPemBytes(bytes []byte, password string) (tls.Certificate, error) {
 }
 
 func unencryptPrivateKey(block *pem.Block, password string) (crypto.PrivateKey, error) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return decryptPKCS8(block.Bytes, password)
+	}
+	// Legacy OpenSSL encryption, with a Proc-Type header.
 	if x509.IsEncryptedPEMBlock(block) {
 		bytes, err := x509.DecryptPEMBlock(block, []byte(password))
 		if err != nil {
@@ -413,10 +1093,17 @@ func unencryptPrivateKey(block *pem.Block, password string) (crypto.PrivateKey,
 	return parsePrivateKey(block.Bytes)
 }
 
+// parsePrivateKey tries PKCS#1, PKCS#8 and SEC 1 (EC) encodings, in that
+// order, like crypto/tls does.
 func parsePrivateKey(bytes []byte) (crypto.PrivateKey, error) {
-	key, err := x509.ParsePKCS1PrivateKey(bytes)
-	if err != nil {
-		return nil, ErrFailedToParsePKCS1PrivateKey
+	if key, err := x509.ParsePKCS1PrivateKey(bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(bytes); err == nil {
+		return key, nil
 	}
-	return key, nil
+	return nil, ErrFailedToParsePrivateKey
 }
@@ -0,0 +1,196 @@
+package apns2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/michele/goosh"
+	"github.com/michele/goosh/worker"
+)
+
+// newTestService returns a PushService sending to an HTTP/2 server running
+// handler, and a function stopping both.
+func newTestService(t *testing.T, handler http.HandlerFunc) (*PushService, func()) {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(handler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	wg := worker.NewWorkerGroup(2)
+	wg.Start()
+	ps := NewPushService(wg.WorkQueue)
+	ps.Logger.SetOutput(ioutil.Discard)
+	ps.Host = strings.TrimPrefix(ts.URL, "https://")
+	ps.RootCAs = x509.NewCertPool()
+	ps.RootCAs.AddCert(ts.Certificate())
+	ps.MaxRetries = 0
+	return ps, func() {
+		wg.Stop()
+		ts.Close()
+	}
+}
+
+// tokenRequest returns a request pushing payload to devices, with a newly
+// generated auth key.
+func tokenRequest(t *testing.T, payload string, devices ...string) goosh.Request {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goosh.Request{
+		APNSAuth: &goosh.APNSAuth{
+			AuthKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			KeyID:   "KEYID",
+			TeamID:  "TEAMID",
+			Topic:   "com.example.app",
+		},
+		Multiplexed: &goosh.Multiplexed{
+			Devices: devices,
+			Payload: json.RawMessage(payload),
+		},
+	}
+}
+
+// getClientWithin fails the test when getClient doesn't return in time,
+// which is how a lock left held shows up.
+func getClientWithin(t *testing.T, ps *PushService, r goosh.Request) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		_, release, err := ps.getClient(r)
+		if release != nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("getClient didn't return")
+		return nil
+	}
+}
+
+func TestGetClientErrorsReleaseTheLock(t *testing.T) {
+	ps := NewPushService(nil)
+	badKey := goosh.Request{APNSAuth: &goosh.APNSAuth{Certificate: "not base64!"}}
+	badCert := goosh.Request{APNSAuth: &goosh.APNSAuth{Certificate: base64.StdEncoding.EncodeToString([]byte("not a certificate"))}}
+	for i := 0; i < 2; i++ {
+		if err := getClientWithin(t, ps, badKey); err == nil {
+			t.Fatalf("getClient #%d with an undecodable certificate succeeded", i+1)
+		}
+		if err := getClientWithin(t, ps, badCert); err == nil {
+			t.Fatalf("getClient #%d with an invalid certificate succeeded", i+1)
+		}
+	}
+}
+
+func TestPayloadSizeLimit(t *testing.T) {
+	var received int64
+	ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+		w.WriteHeader(http.StatusOK)
+	})
+	defer stop()
+	// The payload is sent compacted, as {"aps":{"alert":"..."}}.
+	payload := func(size int) string {
+		return `{"aps":{"alert":"` + strings.Repeat("a", size-len(`{"aps":{"alert":""}}`)) + `"}}`
+	}
+
+	resp, _ := ps.Process(tokenRequest(t, payload(maxPayloadSize), "device"))
+	if resp.Success != 1 || atomic.LoadInt64(&received) != 1 {
+		t.Fatalf("a %d bytes payload wasn't sent: %+v", maxPayloadSize, resp.Devices)
+	}
+
+	resp, _ = ps.Process(tokenRequest(t, payload(maxPayloadSize+1), "device"))
+	if len(resp.Devices) != 1 || resp.Devices[0].Error == nil || resp.Devices[0].Error.Code != 413 {
+		t.Fatalf("a %d bytes payload got %+v, want a 413", maxPayloadSize+1, resp.Devices)
+	}
+	if atomic.LoadInt64(&received) != 1 {
+		t.Fatal("a payload over the limit reached APNS")
+	}
+}
+
+func TestPayloadFilter(t *testing.T) {
+	bodies := make(chan string, 1)
+	ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusOK)
+	})
+	defer stop()
+	payload := `{"aps":{"alert":"hi"},"secret":"x"}`
+
+	ps.PayloadFilter = &goosh.PayloadFilter{Deny: []string{"secret"}}
+	resp, _ := ps.Process(tokenRequest(t, payload, "device"))
+	if len(resp.Devices) != 1 || resp.Devices[0].Error == nil || resp.Devices[0].Error.Code != 422 {
+		t.Fatalf("a denied key got %+v, want a 422", resp.Devices)
+	}
+	select {
+	case b := <-bodies:
+		t.Fatalf("a rejected payload reached APNS: %s", b)
+	default:
+	}
+
+	ps.PayloadFilter.Strip = true
+	resp, _ = ps.Process(tokenRequest(t, payload, "device"))
+	if resp.Success != 1 {
+		t.Fatalf("a stripped payload wasn't sent: %+v", resp.Devices)
+	}
+	if b := <-bodies; b != `{"aps":{"alert":"hi"}}` {
+		t.Fatalf("APNS got %s, want the denied key stripped", b)
+	}
+}
+
+func TestUnregistered(t *testing.T) {
+	tests := []struct {
+		status       int
+		reason       string
+		unregistered bool
+		retry        bool
+	}{
+		{410, "Unregistered", true, false},
+		{410, "BadDeviceToken", true, false},
+		{410, "ExpiredToken", false, false},
+		{400, "BadDeviceToken", false, false},
+		{500, "Unregistered", false, true},
+	}
+	for _, test := range tests {
+		ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(`{"reason":"` + test.reason + `","timestamp":1500000000000}`))
+		})
+		resp, _ := ps.Process(tokenRequest(t, `{"aps":{"alert":"hi"}}`, "device"))
+		stop()
+		if len(resp.Devices) != 1 {
+			t.Fatalf("%d %s: got %d devices, want 1", test.status, test.reason, len(resp.Devices))
+		}
+		dr := resp.Devices[0]
+		if dr.Unregistered != test.unregistered {
+			t.Errorf("%d %s: Unregistered is %t, want %t", test.status, test.reason, dr.Unregistered, test.unregistered)
+		}
+		if dr.Unregistered && (dr.UnregisteredAt == nil || dr.UnregisteredAt.Unix() != 1500000000) {
+			t.Errorf("%d %s: UnregisteredAt is %v, want the timestamp", test.status, test.reason, dr.UnregisteredAt)
+		}
+		if retry := dr.ShouldRetry || dr.Error != nil && dr.Error.ShouldRetry; retry != test.retry {
+			t.Errorf("%d %s: ShouldRetry is %t, want %t", test.status, test.reason, retry, test.retry)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package apns2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/michele/goosh"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// oidUID is the subject attribute Apple stores the bundle ID in.
+var oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// CertificateValidityError is returned for certificates that are expired or
+// not valid yet.
+type CertificateValidityError struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+	Expired   bool
+}
+
+func (e CertificateValidityError) Error() string {
+	if e.Expired {
+		return "certificate expired on " + e.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return "certificate is not valid before " + e.NotBefore.UTC().Format(time.RFC3339)
+}
+
+// CertificateChainError is returned by VerifyChain for certificates that
+// don't chain up to one of the given roots.
+type CertificateChainError struct {
+	Err error
+}
+
+func (e CertificateChainError) Error() string {
+	return "certificate isn't issued by a trusted root: " + e.Err.Error()
+}
+
+// VerifyChain checks that the leaf of cert chains up to one of roots, the
+// other certificates of cert being used as intermediates.
+func VerifyChain(cert tls.Certificate, roots *x509.CertPool) error {
+	if cert.Leaf == nil {
+		return ErrFailedToParseCertificate
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.Wrap(err, "couldn't parse intermediate certificate")
+		}
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return CertificateChainError{Err: err}
+	}
+	return nil
+}
+
+// orderChain puts the leaf of cert, the certificate matching its private
+// key, first and follows it with the intermediates leading from it to its
+// root. Certificates outside of that chain are kept last, in their
+// original order. A chain that can't be parsed is left as it is.
+func orderChain(cert *tls.Certificate) {
+	if len(cert.Certificate) < 2 {
+		return
+	}
+	parsed := make([]*x509.Certificate, len(cert.Certificate))
+	leaf := -1
+	for i, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return
+		}
+		parsed[i] = c
+		if leaf < 0 && matchesKey(c, cert.PrivateKey) {
+			leaf = i
+		}
+	}
+	if leaf < 0 {
+		return
+	}
+	order := []int{leaf}
+	used := map[int]bool{leaf: true}
+	for cur := leaf; ; {
+		next := -1
+		for i, c := range parsed {
+			if !used[i] && bytes.Equal(parsed[cur].RawIssuer, c.RawSubject) && parsed[cur].CheckSignatureFrom(c) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		order = append(order, next)
+		used[next] = true
+		cur = next
+	}
+	for i := range parsed {
+		if !used[i] {
+			order = append(order, i)
+		}
+	}
+	chain := make([][]byte, 0, len(order))
+	for _, i := range order {
+		chain = append(chain, cert.Certificate[i])
+	}
+	cert.Certificate = chain
+}
+
+// matchesKey tells whether c holds the public half of key.
+func matchesKey(c *x509.Certificate, key crypto.PrivateKey) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return false
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(c.PublicKey)
+	return err == nil && bytes.Equal(pub, certPub)
+}
+
+// checkValidity fails when the leaf of cert isn't valid at now.
+func checkValidity(cert tls.Certificate, now time.Time) error {
+	if cert.Leaf == nil {
+		return nil
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return CertificateValidityError{NotBefore: cert.Leaf.NotBefore, NotAfter: cert.Leaf.NotAfter, Expired: true}
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return CertificateValidityError{NotBefore: cert.Leaf.NotBefore, NotAfter: cert.Leaf.NotAfter}
+	}
+	return nil
+}
+
+// CertificateExpiry returns when a base64 encoded APNS certificate, as sent
+// in APNSAuth.Certificate, expires. Both PEM and PKCS#12 are accepted.
+func CertificateExpiry(certB64, password string) (time.Time, error) {
+	data, err := base64.StdEncoding.DecodeString(certB64)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "couldn't decode apns certificate")
+	}
+	pemData, err := certificatePEM(data, password, "")
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert, err := FromPemBytes(pemData, password)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "couldn't parse PEM certificate")
+	}
+	if cert.Leaf == nil {
+		return time.Time{}, ErrFailedToParseCertificate
+	}
+	return cert.Leaf.NotAfter, nil
+}
+
+// certificatePEM returns the PEM form of a decoded APNSAuth.Certificate,
+// converting PKCS#12 bundles. Their bag attributes, friendlyName among them,
+// become PEM headers, so the topic can still be found in the text. Bundles
+// must use the legacy 3DES or RC2 encryption, OpenSSL 3 needs -legacy.
+func certificatePEM(data []byte, password, format string) ([]byte, error) {
+	if format == "" {
+		format = goosh.CertificateFormatPKCS12
+		if bytes.Contains(data, []byte("-----BEGIN")) {
+			format = goosh.CertificateFormatPEM
+		}
+	}
+	switch format {
+	case goosh.CertificateFormatPEM:
+		return data, nil
+	case goosh.CertificateFormatPKCS12:
+	default:
+		return nil, errors.Errorf("unknown certificate format %q", format)
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't decode PKCS#12 certificate")
+	}
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		err = pem.Encode(&buf, b)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't encode PKCS#12 certificate as PEM")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+var friendlyNameTopic = regexp.MustCompile(`(?mi)^\s*friendlyName: [^:]+ Push Services: (.*)$`)
+
+// certificateTopic reads the bundle ID from the UID of the certificate's
+// subject, falling back to the friendlyName OpenSSL writes in the PEM text.
+func certificateTopic(leaf *x509.Certificate, pemData []byte) string {
+	if leaf != nil {
+		for _, n := range leaf.Subject.Names {
+			if !n.Type.Equal(oidUID) {
+				continue
+			}
+			if uid, ok := n.Value.(string); ok && uid != "" {
+				return uid
+			}
+		}
+	}
+	ss := friendlyNameTopic.FindSubmatch(pemData)
+	if len(ss) > 0 {
+		return strings.TrimSpace(string(ss[1]))
+	}
+	return ""
+}
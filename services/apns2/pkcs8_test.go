@@ -0,0 +1,117 @@
+package apns2
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The fixtures in testdata are encrypted with "secret", by OpenSSL:
+//
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256 (ec-pkcs8-aes256.pem)
+//	openssl pkcs8 -topk8 -v2 des3 -v2prf hmacWithSHA1 (ec-pkcs8-des3.pem)
+//	openssl pkcs8 -topk8 -v2 aes-128-cbc (rsa-pkcs8-aes128.pem)
+//	openssl ec -aes128 (ec-legacy.pem)
+//	openssl rsa -traditional -aes128 (rsa-legacy.pem)
+func readKeyBlock(t *testing.T, name string) *pem.Block {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatalf("%s has no PEM block", name)
+	}
+	return block
+}
+
+func TestUnencryptPrivateKey(t *testing.T) {
+	tests := []struct {
+		file string
+		ec   bool
+	}{
+		{"ec-pkcs8-aes256.pem", true},
+		{"ec-pkcs8-des3.pem", true},
+		{"rsa-pkcs8-aes128.pem", false},
+		{"ec-legacy.pem", true},
+		{"rsa-legacy.pem", false},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			block := readKeyBlock(t, test.file)
+			key, err := unencryptPrivateKey(block, "secret")
+			if err != nil {
+				t.Fatalf("couldn't decrypt: %v", err)
+			}
+			switch key.(type) {
+			case *ecdsa.PrivateKey:
+				if !test.ec {
+					t.Fatalf("got an EC key, want RSA")
+				}
+			case *rsa.PrivateKey:
+				if test.ec {
+					t.Fatalf("got an RSA key, want EC")
+				}
+			default:
+				t.Fatalf("got a %T", key)
+			}
+			if _, err := unencryptPrivateKey(block, "wrong"); err != ErrFailedToDecryptKey {
+				t.Fatalf("wrong password returned %v, want ErrFailedToDecryptKey", err)
+			}
+		})
+	}
+}
+
+// withIterations returns the encrypted PKCS#8 key der, its PBKDF2 iteration
+// count replaced by n.
+func withIterations(t *testing.T, der []byte, n int) []byte {
+	t.Helper()
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		t.Fatal(err)
+	}
+	kdf.IterationCount = n
+	b, err := asn1.Marshal(kdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.KeyDerivationFunc.Parameters = asn1.RawValue{FullBytes: b}
+	if b, err = asn1.Marshal(params); err != nil {
+		t.Fatal(err)
+	}
+	info.Algorithm.Parameters = asn1.RawValue{FullBytes: b}
+	if b, err = asn1.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPBKDF2IterationsBounds(t *testing.T) {
+	der := readKeyBlock(t, "ec-pkcs8-aes256.pem").Bytes
+	if _, err := decryptPKCS8(withIterations(t, der, 2048), "secret"); err != nil {
+		t.Fatalf("re-encoding the fixture broke it: %v", err)
+	}
+	for _, n := range []int{0, -1, maxPBKDF2Iterations + 1, 1 << 30} {
+		start := time.Now()
+		if _, err := decryptPKCS8(withIterations(t, der, n), "secret"); err != ErrFailedToDecryptKey {
+			t.Errorf("%d iterations returned %v, want ErrFailedToDecryptKey", n, err)
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("%d iterations took %s to be refused", n, took)
+		}
+	}
+}
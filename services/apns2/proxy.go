@@ -0,0 +1,106 @@
+package apns2
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyTimeout bounds connecting to a proxy, tunneling through it and the
+// TLS handshake with APNS on the other side.
+const proxyTimeout = 30 * time.Second
+
+// dial connects to addr through the proxy Proxy picks for it, or directly
+// when there's none. http2.Transport ignores proxies, so the tunnel is
+// opened here with a CONNECT before the TLS handshake with APNS.
+func (ps *PushService) dial(network, addr string, cfg *tls.Config) (net.Conn, error) {
+	var proxy *url.URL
+	if ps.Proxy != nil {
+		var err error
+		proxy, err = ps.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't pick a proxy")
+		}
+	}
+	if proxy == nil {
+		return dialTLS(network, addr, cfg)
+	}
+	conn, err := dialProxy(network, addr, proxy)
+	if err != nil {
+		return nil, err
+	}
+	tconn := tls.Client(conn, cfg)
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
+// dialProxy opens a tunnel to addr through an HTTP or HTTPS proxy. The
+// connection is returned with a deadline of proxyTimeout, for the handshake
+// that follows.
+func dialProxy(network, addr string, proxy *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   proxyTimeout,
+		KeepAlive: 360 * time.Second,
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		if proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+		}
+	}
+	var conn net.Conn
+	var err error
+	switch proxy.Scheme {
+	case "http":
+		conn, err = dialer.Dial(network, proxyAddr)
+	case "https":
+		conn, err = tls.DialWithDialer(dialer, network, proxyAddr, &tls.Config{ServerName: proxy.Hostname()})
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't connect to the proxy")
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "couldn't write CONNECT to the proxy")
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "couldn't read the proxy's response")
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		conn.Close()
+		return nil, errors.Errorf("proxy refused the tunnel: %s", res.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("proxy sent data before the TLS handshake")
+	}
+	return conn, nil
+}
@@ -0,0 +1,126 @@
+package apns2
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tokenLifetime is how long a provider token is reused before a new one is
+// signed. Apple rejects tokens older than an hour.
+const tokenLifetime = 50 * time.Minute
+
+var (
+	ErrInvalidAuthKey = errors.New("invalid APNS auth key")
+	ErrMissingKeyID   = errors.New("missing APNS key ID")
+	ErrMissingTeamID  = errors.New("missing APNS team ID")
+)
+
+// tokenSigner issues the ES256 JWTs used for token-based (.p8) provider
+// authentication, regenerating them once they get close to expiring.
+type tokenSigner struct {
+	key      *ecdsa.PrivateKey
+	keyID    string
+	teamID   string
+	lock     sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func newTokenSigner(authKey, keyID, teamID string) (*tokenSigner, error) {
+	if keyID == "" {
+		return nil, ErrMissingKeyID
+	}
+	if teamID == "" {
+		return nil, ErrMissingTeamID
+	}
+	key, err := parseAuthKey(authKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenSigner{key: key, keyID: keyID, teamID: teamID}, nil
+}
+
+// parseAuthKey accepts the contents of a .p8 file, either as is or base64
+// encoded like APNSAuth.Certificate.
+func parseAuthKey(authKey string) (*ecdsa.PrivateKey, error) {
+	pemData := []byte(authKey)
+	if !strings.HasPrefix(strings.TrimSpace(authKey), "-----BEGIN") {
+		decoded, err := base64.StdEncoding.DecodeString(authKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't decode apns auth key")
+		}
+		pemData = decoded
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, ErrInvalidAuthKey
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidAuthKey
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidAuthKey
+	}
+	return key, nil
+}
+
+// Bearer returns a valid provider token, signing a new one if needed.
+func (t *tokenSigner) Bearer() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != "" && time.Since(t.issuedAt) < tokenLifetime {
+		return t.token, nil
+	}
+	now := time.Now()
+	token, err := t.sign(now)
+	if err != nil {
+		return "", err
+	}
+	t.token = token
+	t.issuedAt = now
+	return token, nil
+}
+
+// Reset drops the current token so the next call to Bearer signs a new one.
+func (t *tokenSigner) Reset() {
+	t.lock.Lock()
+	t.token = ""
+	t.lock.Unlock()
+}
+
+func (t *tokenSigner) sign(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": t.keyID})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal JWT header")
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": t.teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal JWT claims")
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't sign JWT")
+	}
+	// ES256 signatures are the fixed-size concatenation of r and s.
+	size := (t.key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rb):size], rb)
+	copy(sig[2*size-len(sb):], sb)
+	return input + "." + enc.EncodeToString(sig), nil
+}
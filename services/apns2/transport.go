@@ -0,0 +1,47 @@
+package apns2
+
+import (
+	stderrors "errors"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/michele/goosh"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// classifyTransportError maps an error returned by the HTTP/2 client to a
+// goosh.Error kind and a description telling what went wrong.
+func classifyTransportError(err error) (string, string) {
+	cause := errors.Cause(err)
+	if ue, ok := cause.(*url.Error); ok {
+		cause = ue.Err
+	}
+	switch e := cause.(type) {
+	case http2.StreamError:
+		if e.Code == http2.ErrCodeRefusedStream {
+			return goosh.KindRefusedStream, "APNS refused the stream"
+		}
+		return goosh.KindStreamReset, "APNS reset the stream (" + e.Code.String() + ")"
+	case http2.GoAwayError:
+		return goosh.KindGoAway, "APNS closed the connection with GOAWAY (" + e.ErrCode.String() + ")"
+	case http2.ConnectionError:
+		return goosh.KindConnectionReset, "HTTP/2 connection error (" + http2.ErrCode(e).String() + ")"
+	}
+	if stderrors.Is(cause, syscall.ECONNRESET) {
+		return goosh.KindConnectionReset, "connection to APNS was reset"
+	}
+	if ne, ok := cause.(net.Error); ok && ne.Timeout() {
+		return goosh.KindTimeout, "request to APNS timed out"
+	}
+	msg := cause.Error()
+	switch {
+	case strings.Contains(msg, "GOAWAY"):
+		return goosh.KindGoAway, "APNS closed the connection with GOAWAY"
+	case strings.Contains(msg, "connection reset"):
+		return goosh.KindConnectionReset, "connection to APNS was reset"
+	}
+	return goosh.KindNetwork, "couldn't make request to APNS"
+}
@@ -0,0 +1,146 @@
+package apns2
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/michele/goosh"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyTransportError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{http2.StreamError{Code: http2.ErrCodeRefusedStream}, goosh.KindRefusedStream},
+		{http2.StreamError{Code: http2.ErrCodeInternal}, goosh.KindStreamReset},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeEnhanceYourCalm}, goosh.KindGoAway},
+		{http2.ConnectionError(http2.ErrCodeProtocol), goosh.KindConnectionReset},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, goosh.KindConnectionReset},
+		{timeoutError{}, goosh.KindTimeout},
+		{errors.New("http2: server sent GOAWAY and closed the connection"), goosh.KindGoAway},
+		{errors.New("something else"), goosh.KindNetwork},
+	}
+	for _, test := range tests {
+		// Errors reach classifyTransportError wrapped by http.Client and by
+		// Push.
+		err := errors.Wrap(&url.Error{Op: "Post", URL: "https://apns", Err: test.err}, "couldn't make request to APNS")
+		if kind, _ := classifyTransportError(err); kind != test.kind {
+			t.Errorf("%v classified as %s, want %s", test.err, kind, test.kind)
+		}
+	}
+}
+
+// serveGoAway answers the first request of every connection with a GOAWAY,
+// then closes the connection.
+func serveGoAway(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			preface := make([]byte, len(http2.ClientPreface))
+			if _, err := io.ReadFull(conn, preface); err != nil {
+				return
+			}
+			fr := http2.NewFramer(conn, conn)
+			fr.WriteSettings()
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				switch f := f.(type) {
+				case *http2.SettingsFrame:
+					if !f.IsAck() {
+						fr.WriteSettingsAck()
+					}
+				case *http2.HeadersFrame:
+					fr.WriteGoAway(f.StreamID, http2.ErrCodeEnhanceYourCalm, nil)
+					// Closing with unread data would reset the connection
+					// before the client reads the GOAWAY.
+					conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+					io.Copy(ioutil.Discard, conn)
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestTransportErrorKinds(t *testing.T) {
+	t.Run("stream reset", func(t *testing.T) {
+		ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})
+		defer stop()
+		resp, _ := ps.Process(tokenRequest(t, `{"aps":{"alert":"hi"}}`, "device"))
+		assertKind(t, resp, goosh.KindStreamReset)
+	})
+
+	t.Run("goaway", func(t *testing.T) {
+		ps, stop := newTestService(t, nil)
+		defer stop()
+		// The test server's certificate, trusted by ps, is reused by a
+		// listener speaking raw HTTP/2 frames.
+		ts := httptest.NewUnstartedServer(nil)
+		ts.EnableHTTP2 = true
+		ts.StartTLS()
+		defer ts.Close()
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: ts.TLS.Certificates,
+			NextProtos:   []string{http2.NextProtoTLS},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go serveGoAway(ln)
+		ps.Host = ln.Addr().String()
+		ps.RootCAs.AddCert(ts.Certificate())
+		resp, _ := ps.Process(tokenRequest(t, `{"aps":{"alert":"hi"}}`, "device"))
+		assertKind(t, resp, goosh.KindGoAway)
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		ps, stop := newTestService(t, nil)
+		defer stop()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps.Host = ln.Addr().String()
+		ln.Close()
+		resp, _ := ps.Process(tokenRequest(t, `{"aps":{"alert":"hi"}}`, "device"))
+		assertKind(t, resp, goosh.KindNetwork)
+	})
+}
+
+func assertKind(t *testing.T, resp goosh.Response, kind string) {
+	t.Helper()
+	if len(resp.Devices) != 1 || resp.Devices[0].Error == nil {
+		t.Fatalf("got %+v, want a failed device", resp.Devices)
+	}
+	e := resp.Devices[0].Error
+	if e.Code != 502 || e.Kind != kind {
+		t.Fatalf("got %+v, want a 502 of kind %s", e, kind)
+	}
+}
@@ -2,36 +2,123 @@ package fcm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/michele/factotum"
 	"github.com/michele/goosh"
+	"github.com/michele/goosh/worker"
 	"github.com/pkg/errors"
 )
 
 const fcmChunkSize = 1000
+
+// maxPayloadSize is the largest payload, in bytes, FCM accepts.
+const maxPayloadSize = 4096
 const fcmURI = "https://fcm.googleapis.com/fcm/send"
 const initialBackoff = 5
 const maxBackoff = 300
 
-var (
+const (
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultRequestTimeout        = 60 * time.Second
+)
+
+// backoff is the 5xx backoff state of a single FCM auth key.
+type backoff struct {
 	waitUntil   time.Time
 	currentWait int64
-	backoffLock sync.Mutex
-)
+}
+
+// defaultURL is the FCM endpoint, overridden by GOOSH_FCM_URL when it's set
+// to a valid http(s) URL.
+var defaultURL = fcmURI
+
+var envErr error
+
+func init() {
+	if u := os.Getenv("GOOSH_FCM_URL"); len(u) > 0 {
+		if validURL(u) {
+			defaultURL = u
+		} else {
+			envErr = errors.Errorf("invalid GOOSH_FCM_URL %q", u)
+		}
+	}
+}
+
+// EnvError returns why GOOSH_FCM_URL couldn't be used, if it's set to
+// something that isn't an http(s) URL. PushServices then send to FCM's own
+// endpoint.
+func EnvError() error {
+	return envErr
+}
 
 type PushService struct {
 	client          *client
-	queue           chan factotum.WorkRequest
+	lock            sync.Mutex
+	tokens          map[string]*tokenSource
+	backoffLock     sync.Mutex
+	backoffs        map[string]*backoff
+	queue           chan worker.WorkRequest
 	Instrument      bool
 	InstrumentPush  func(time.Duration)
 	InstrumentError func(int)
+	// PayloadFilter restricts the top-level payload keys sent to FCM. A nil
+	// filter forwards payloads untouched.
+	PayloadFilter *goosh.PayloadFilter
+	// DefaultPayload is deep-merged under every push's payload, so values
+	// set by the caller win over it.
+	DefaultPayload json.RawMessage
+	// URL is the endpoint pushes are POSTed to. NewPushService initializes
+	// it from GOOSH_FCM_URL (falling back to FCM's own endpoint), so a value
+	// assigned after construction takes precedence over the environment.
+	URL string
+	// V1BaseURL is the HTTP v1 endpoint root used by requests that
+	// authenticate with a service account.
+	V1BaseURL string
+	// Log receives the structured logs.
+	Log goosh.Logger
+	// IdleConnTimeout, ResponseHeaderTimeout and TLSHandshakeTimeout
+	// configure the HTTP transport shared by every push. It's created on
+	// the first push, so changes made afterwards don't apply. Zero disables
+	// the corresponding timeout.
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSHandshakeTimeout   time.Duration
+	// RequestTimeout bounds every call to FCM, from dialing to reading the
+	// response. A push timing out is retried. Zero only relies on the
+	// context of the request.
+	RequestTimeout time.Duration
+	// Proxy picks the proxy the calls to FCM go through, none when it
+	// returns nil. NewPushService sets it to http.ProxyFromEnvironment,
+	// which reads HTTPS_PROXY and NO_PROXY. Like the timeouts, it only
+	// applies before the first push.
+	Proxy func(*http.Request) (*url.URL, error)
+	// RatePerSecond, when positive, limits the calls made to FCM with every
+	// auth key or service account project, allowing bursts of Burst calls.
+	// Calls wait for their turn before being queued, and their devices are
+	// reported as canceled when the request's deadline would pass first.
+	// Changes only apply before the first push.
+	RatePerSecond float64
+	Burst         int
+	limiter       *goosh.RateLimiter
+	// MaxRequestConcurrency, when positive, caps how many calls of a single
+	// request may be queued or running at once, so that a large request
+	// can't take all the workers. Zero removes the cap.
+	MaxRequestConcurrency int
+	// Workers, when set, is the group reading the queue. Requests then
+	// register with it while fanning out, so that stopping it waits for
+	// their devices to be queued rather than dropping them.
+	Workers *worker.WorkerGroup
 }
 
 type client struct {
@@ -55,33 +142,76 @@ type response struct {
 type result struct {
 	MessageID string `json:"message_id,omitempty"`
 	Error     string `json:"error,omitempty"`
+	// RegistrationID is the canonical registration ID, when the one used
+	// should be replaced.
+	RegistrationID string `json:"registration_id,omitempty"`
+}
+
+type topicResult struct {
+	MessageID int64  `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
 type workRequest struct {
-	msg  goosh.Message
-	res  chan<- goosh.DeviceResponse
-	cli  *client
-	akey string
-	ps   *PushService
+	ctx     context.Context
+	msg     goosh.Message
+	devices []string
+	res     chan<- goosh.DeviceResponse
+	cli     *client
+	akey    string
+	ts      *tokenSource
+	ps      *PushService
+	slots   goosh.Semaphore
 }
 
-func NewPushService(q chan factotum.WorkRequest) (ps *PushService) {
+func NewPushService(q chan worker.WorkRequest) (ps *PushService) {
 	ps = &PushService{}
-	ps.client = newClient()
 	ps.queue = q
+	ps.URL = defaultURL
+	ps.V1BaseURL = v1BaseURL
+	ps.tokens = map[string]*tokenSource{}
+	ps.backoffs = map[string]*backoff{}
+	ps.Log = goosh.DefaultLogger()
+	ps.IdleConnTimeout = defaultIdleConnTimeout
+	ps.ResponseHeaderTimeout = defaultResponseHeaderTimeout
+	ps.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	ps.RequestTimeout = defaultRequestTimeout
+	ps.Proxy = http.ProxyFromEnvironment
 	return ps
 }
 
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
 func (r result) OK() bool {
 	return r.Error == ""
 }
 
-func newClient() *client {
+// getClient returns the client shared by every push, creating it the first
+// time.
+func (ps *PushService) getClient() *client {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ps.client == nil {
+		ps.client = ps.newClient()
+	}
+	return ps.client
+}
+
+func (ps *PushService) newClient() *client {
 	newfcm := client{}
 
 	tr := &http.Transport{
-		MaxIdleConnsPerHost: 1024,
-		TLSHandshakeTimeout: 0 * time.Second,
+		Proxy:                 ps.Proxy,
+		MaxIdleConnsPerHost:   1024,
+		IdleConnTimeout:       ps.IdleConnTimeout,
+		ResponseHeaderTimeout: ps.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   ps.TLSHandshakeTimeout,
 	}
 	cli := &http.Client{
 		Transport: tr,
@@ -92,72 +222,316 @@ func newClient() *client {
 	return &newfcm
 }
 
-func ShouldWait() bool {
-	backoffLock.Lock()
-	shoulda := waitUntil.After(time.Now())
-	backoffLock.Unlock()
-	return shoulda
+// missingAuthKey tells whether a device of r has no legacy auth key.
+func missingAuthKey(r goosh.Request) bool {
+	if r.FCMAuth.AuthKey != "" {
+		return false
+	}
+	for msg := range r.Messages() {
+		if r.FCMAuth.KeyFor(msg.Token) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldWait tells whether FCM asked to back off the given auth key.
+//
+// ShouldWait and RetryAfter are exported for library users scheduling their
+// own pushes: the service doesn't consult them before sending, the failed
+// devices carrying the same deadline in their Error.RetryAt.
+func (ps *PushService) ShouldWait(authKey string) bool {
+	ps.backoffLock.Lock()
+	defer ps.backoffLock.Unlock()
+	b, ok := ps.backoffs[authKey]
+	return ok && b.waitUntil.After(time.Now())
 }
 
-func RetryAfter() int {
-	if ShouldWait() {
-		backoffLock.Lock()
-		defer backoffLock.Unlock()
-		return int(time.Now().Sub(waitUntil))
+// RetryAfter returns how long to wait before pushing with the given auth
+// key again.
+func (ps *PushService) RetryAfter(authKey string) time.Duration {
+	ps.backoffLock.Lock()
+	defer ps.backoffLock.Unlock()
+	b, ok := ps.backoffs[authKey]
+	if ok && b.waitUntil.After(time.Now()) {
+		return b.waitUntil.Sub(time.Now())
 	}
 	return 0
 }
 
-func (ps *PushService) Process(r goosh.Request) (resp goosh.Response, err error) {
+// BackingOff tells whether every auth key FCM answered is backing off, so
+// that no push can get through until one of them is done waiting. Keys are
+// known once FCM answered a push sent with them.
+func (ps *PushService) BackingOff() bool {
+	ps.backoffLock.Lock()
+	defer ps.backoffLock.Unlock()
+	if len(ps.backoffs) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, b := range ps.backoffs {
+		if !b.waitUntil.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// known records authKey for BackingOff, leaving its backoff as it is.
+func (ps *PushService) known(authKey string) {
+	ps.backoffLock.Lock()
+	defer ps.backoffLock.Unlock()
+	if _, ok := ps.backoffs[authKey]; !ok {
+		ps.backoffs[authKey] = &backoff{}
+	}
+}
+
+func (ps *PushService) Process(r goosh.Request) (goosh.Response, error) {
+	return ps.ProcessContext(context.Background(), r)
+}
+
+func (ps *PushService) ProcessContext(ctx context.Context, r goosh.Request) (goosh.Response, error) {
+	return ps.process(ctx, r, nil)
+}
+
+func (ps *PushService) ProcessStream(ctx context.Context, r goosh.Request, devices chan<- goosh.DeviceResponse) (goosh.Response, error) {
+	return ps.process(ctx, r, devices)
+}
+
+// process sends r, collecting the DeviceResponses in the returned Response
+// unless stream is set, in which case they're sent there.
+func (ps *PushService) process(ctx context.Context, r goosh.Request, stream chan<- goosh.DeviceResponse) (resp goosh.Response, err error) {
 	if r.Count() <= 0 {
 		return
 	}
+	ctx, cancel := r.WithTimeout(ctx)
+	defer cancel()
 
 	resp.CustomID = r.CustomID
-	resp.Service = "fcm"
+	resp.Service = goosh.ServiceFCM
+	if !r.FCMAuth.UsesV1() && missingAuthKey(r) {
+		err = errors.New("missing FCM auth key")
+		resp = goosh.FailedResponse(r, goosh.ServiceFCM, &goosh.Error{
+			ShouldRetry: false,
+			Code:        422,
+			Description: "MissingAuthKey",
+		})
+		return
+	}
+	if err = r.FCMAuth.ValidateOptions(); err != nil {
+		resp = goosh.FailedResponse(r, goosh.ServiceFCM, &goosh.Error{
+			ShouldRetry: false,
+			Code:        422,
+			Description: "InvalidOptions: " + err.Error(),
+		})
+		return
+	}
+	if b := r.Broadcast; b != nil && (b.Topic == "") == (b.Condition == "") {
+		err = errors.New("broadcast needs either a topic or a condition")
+		resp = goosh.FailedResponse(r, goosh.ServiceFCM, &goosh.Error{
+			ShouldRetry: false,
+			Code:        422,
+			Description: "InvalidBroadcast",
+		})
+		return
+	}
+	var ts *tokenSource
+	if r.FCMAuth.UsesV1() {
+		ts, err = ps.tokenSource(*r.FCMAuth)
+		if err != nil {
+			resp = goosh.FailedResponse(r, goosh.ServiceFCM, &goosh.Error{
+				ShouldRetry: false,
+				Code:        401,
+				Description: "InvalidServiceAccount: " + errors.Cause(err).Error(),
+			})
+			err = errors.Wrap(err, "Couldn't get token source")
+			return
+		}
+	}
+	if ps.Workers != nil && !ps.Workers.AddProducer() {
+		err = errors.New("the FCM workers are stopping")
+		resp = goosh.FailedResponse(r, goosh.ServiceFCM, &goosh.Error{
+			ShouldRetry: true,
+			Code:        503,
+			Description: "ShuttingDown",
+		})
+		return
+	}
 	results := make(chan goosh.DeviceResponse, 10)
 	left := r.Count()
+	msgs := r.Messages()
+	slots := goosh.NewSemaphore(ps.MaxRequestConcurrency)
 	go func() {
-		for r.Next() {
-			wr := workRequest{
-				msg:  r.Value(),
-				cli:  ps.client,
-				res:  results,
-				akey: r.FCMAuth.AuthKey,
-				ps:   ps,
+		if ps.Workers != nil {
+			defer ps.Workers.ProducerDone()
+		}
+		// Multiplexed devices come first and share a payload, so they're
+		// sent in chunks of registration_ids. Batched ones go one by one.
+		// HTTP v1 has no multicast, every device is sent on its own.
+		multiplexed := 0
+		if r.Multiplexed != nil && ts == nil {
+			multiplexed = len(r.Multiplexed.Devices)
+		}
+		// A chunk only holds devices sharing the same auth key.
+		chunks := map[string][]string{}
+		var keys []string
+		i := 0
+		for msg := range msgs {
+			i++
+			if i > multiplexed {
+				ps.enqueue(ctx, slots, ps.workRequest(ctx, r, ts, msg, []string{msg.Token}, results))
+				continue
+			}
+			key := r.FCMAuth.KeyFor(msg.Token)
+			if _, ok := chunks[key]; !ok {
+				keys = append(keys, key)
+			}
+			chunks[key] = append(chunks[key], msg.Token)
+			if len(chunks[key]) == fcmChunkSize {
+				ps.enqueue(ctx, slots, ps.workRequest(ctx, r, ts, msg, chunks[key], results))
+				chunks[key] = []string{}
+			}
+			if i == multiplexed {
+				for _, k := range keys {
+					if len(chunks[k]) > 0 {
+						ps.enqueue(ctx, slots, ps.workRequest(ctx, r, ts, msg, chunks[k], results))
+					}
+				}
 			}
-			ps.queue <- wr
 		}
 	}()
 
-	resps := []goosh.DeviceResponse{}
-	var success int64
-	var failed int64
+	resp = goosh.Response{
+		Devices:  []goosh.DeviceResponse{},
+		PushID:   r.PushID,
+		CustomID: r.CustomID,
+		Service:  goosh.ServiceFCM,
+		DryRun:   r.DryRun || r.VerifyTokens,
+	}
 	for ; left > 0; left-- {
 		select {
 		case dr, ok := <-results:
 			if !ok {
 				left = 0
 			}
-			resps = append(resps, dr)
 			if dr.Delivered {
-				success++
+				resp.Success++
 			} else {
-				failed++
+				resp.Failure++
+			}
+			if dr.Unregistered {
+				resp.Unregistered = append(resp.Unregistered, dr.Identifier)
+			}
+			if stream == nil {
+				resp.Devices = append(resp.Devices, dr)
+				continue
 			}
+			if r.SplitSections {
+				resp.CountSection(dr)
+			}
+			stream <- dr
 		}
 	}
-	resp = goosh.Response{
-		Devices:  resps,
-		PushID:   r.PushID,
-		Success:  success,
-		Failure:  failed,
-		CustomID: r.CustomID,
-		Service:  "fcm",
+	if stream == nil {
+		resp.SortDevices(r)
+	}
+	if stream == nil && r.SplitSections {
+		resp.SummarizeSections()
 	}
 	return
 }
 
+func (ps *PushService) workRequest(ctx context.Context, r goosh.Request, ts *tokenSource, msg goosh.Message, devices []string, results chan<- goosh.DeviceResponse) workRequest {
+	return workRequest{
+		ctx:     ctx,
+		msg:     msg,
+		devices: devices,
+		cli:     ps.getClient(),
+		res:     results,
+		akey:    r.FCMAuth.KeyFor(devices[0]),
+		ts:      ts,
+		ps:      ps,
+	}
+}
+
+// requestContext derives the context of a single call to FCM from ctx,
+// applying RequestTimeout.
+func (ps *PushService) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ps.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, ps.RequestTimeout)
+}
+
+// enqueue hands wr to the workers once it gets one of the request's slots,
+// unless ctx is done first: then its devices are reported as canceled.
+func (ps *PushService) enqueue(ctx context.Context, slots goosh.Semaphore, wr workRequest) {
+	key := wr.akey
+	if wr.ts != nil {
+		key = wr.ts.projectID
+	}
+	if err := ps.limit(ctx, key); err != nil {
+		wr.cancel(err)
+		return
+	}
+	if err := slots.Acquire(ctx); err != nil {
+		wr.cancel(err)
+		return
+	}
+	wr.slots = slots
+	err := ctx.Err()
+	if err == nil {
+		if err = ps.send(ctx, wr); err == nil {
+			return
+		}
+	}
+	slots.Release()
+	wr.cancel(err)
+}
+
+// send queues wr, through Workers when it's set.
+func (ps *PushService) send(ctx context.Context, wr workRequest) error {
+	if ps.Workers != nil {
+		return ps.Workers.Send(ctx, wr)
+	}
+	select {
+	case ps.queue <- wr:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limit waits for the rate limiter to allow another call with key.
+func (ps *PushService) limit(ctx context.Context, key string) error {
+	ps.lock.Lock()
+	if ps.limiter == nil && ps.RatePerSecond > 0 {
+		ps.limiter = goosh.NewRateLimiter(ps.RatePerSecond, ps.Burst)
+	}
+	l := ps.limiter
+	ps.lock.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Wait(ctx, key)
+}
+
+func (wr workRequest) cancel(err error) {
+	for _, d := range wr.devices {
+		msg := wr.msg
+		msg.Token = d
+		wr.res <- goosh.CanceledResponse(msg, err)
+	}
+}
+
+// SetInstrumentation turns instrumentation on, reporting to the given
+// hooks.
+func (ps *PushService) SetInstrumentation(push func(time.Duration), errs func(int)) {
+	ps.InstrumentPush = push
+	ps.InstrumentError = errs
+	ps.Instrument = true
+}
+
 func (ps *PushService) instrumentError(code int) {
 	if ps.Instrument && ps.InstrumentError != nil {
 		ps.InstrumentError(code)
@@ -170,150 +544,352 @@ func (ps *PushService) instrumentPush(took time.Duration) {
 	}
 }
 
-func (cli *client) push(authKey string, msg goosh.Message, ps *PushService) (goosh.DeviceResponse, error) {
-	dr := goosh.DeviceResponse{
-		Identifier: msg.Token,
+// preparePayload applies the service's default payload and payload filter
+// to a push payload.
+func (ps *PushService) preparePayload(p json.RawMessage) (json.RawMessage, *goosh.Error, error) {
+	payload, err := goosh.MergePayload(ps.DefaultPayload, p)
+	if err != nil {
+		err = errors.Wrap(err, "couldn't merge default payload")
+		return nil, &goosh.Error{
+			Code:        422,
+			Description: "(pre-validation) invalid payload",
+		}, err
+	}
+	payload, err = ps.PayloadFilter.Apply(payload)
+	if err != nil {
+		err = errors.Wrap(err, "payload rejected by filter")
+		return nil, &goosh.Error{
+			Code:        422,
+			Description: "(pre-validation) " + errors.Cause(err).Error(),
+		}, err
+	}
+	var compact bytes.Buffer
+	if json.Compact(&compact, payload) == nil && compact.Len() > maxPayloadSize {
+		err = errors.Errorf("payload of %d bytes is over the %d bytes limit", compact.Len(), maxPayloadSize)
+		return nil, &goosh.Error{
+			Code:        413,
+			Description: "(pre-validation) payload too large",
+		}, err
 	}
-	payloadB, err := composePayload([]string{msg.Token}, msg.Payload)
+	err = checkPayload(payload)
+	if err != nil {
+		return nil, &goosh.Error{
+			Code:        422,
+			Description: "(pre-validation) " + err.Error(),
+		}, err
+	}
+	return payload, nil, nil
+}
+
+// checkPayload makes sure payload is a JSON object carrying something to
+// deliver: a notification or data, or an HTTP v1 message or platform block.
+// notification and data must be objects.
+func checkPayload(payload json.RawMessage) error {
+	var parsed map[string]json.RawMessage
+	err := json.Unmarshal(payload, &parsed)
+	if err != nil || parsed == nil {
+		return errors.New("payload isn't a JSON object")
+	}
+	found := false
+	for _, k := range []string{"notification", "data", "message", "android", "apns", "webpush"} {
+		v, ok := parsed[k]
+		if !ok {
+			continue
+		}
+		found = true
+		if k != "notification" && k != "data" {
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(v, &obj) != nil || obj == nil {
+			return errors.Errorf("%s isn't an object", k)
+		}
+	}
+	if !found {
+		return errors.New("payload has neither notification nor data")
+	}
+	return nil
+}
+
+// backoffFrom records a 5xx from FCM in the backoff state of authKey and
+// returns when it's fine to retry.
+func (ps *PushService) backoffFrom(authKey string, resp *http.Response) time.Time {
+	ps.backoffLock.Lock()
+	defer ps.backoffLock.Unlock()
+	b, ok := ps.backoffs[authKey]
+	if !ok {
+		b = &backoff{}
+		ps.backoffs[authKey] = b
+	}
+	b.waitUntil = time.Now()
+	retryAfter := resp.Header.Get("Retry-After")
+	if retryAfter != "" {
+		// Retry-After is either a number of seconds or an HTTP-date.
+		if retryInt, err := strconv.Atoi(retryAfter); err == nil {
+			b.waitUntil = b.waitUntil.Add(time.Duration(retryInt) * time.Second)
+		} else if date, err := http.ParseTime(retryAfter); err == nil && date.After(b.waitUntil) {
+			b.waitUntil = date
+		}
+		if b.currentWait == 0 {
+			b.currentWait = initialBackoff
+		} else {
+			b.currentWait = minInt(b.currentWait*2, maxBackoff)
+		}
+		b.waitUntil = b.waitUntil.Add(time.Duration(b.currentWait) * time.Second)
+	}
+	return b.waitUntil
+}
+
+func (cli *client) push(ctx context.Context, authKey string, msg goosh.Message, devices []string, ps *PushService) ([]goosh.DeviceResponse, error) {
+	fail := func(e *goosh.Error, err error) ([]goosh.DeviceResponse, error) {
+		return assignErrorToDevices(e, devices, e.ShouldRetry), err
+	}
+	payload, perr, err := ps.preparePayload(msg.Payload)
+	if err != nil {
+		return fail(perr, err)
+	}
+	payloadB, err := composePayload(devices, payload, msg)
 	if err != nil {
 		err = errors.Wrap(err, "composePayload returned an error")
-		dr.Error = &goosh.Error{
+		return fail(&goosh.Error{
 			Code:        422,
 			Description: "(pre-validation) invalid payload",
-		}
-		return dr, err
+		}, err)
 	}
 
-	req, err := http.NewRequest("POST", fcmURI, ioutil.NopCloser(bytes.NewBuffer(payloadB)))
+	reqCtx, cancel := ps.requestContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, "POST", ps.URL, ioutil.NopCloser(bytes.NewBuffer(payloadB)))
 	if err != nil {
 		err = errors.Wrap(err, "couldn't build FCM request")
-		dr.Error = &goosh.Error{
+		return fail(&goosh.Error{
 			Code:        500,
 			Description: "couldn't build request",
-		}
-		return dr, err
+		}, err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Authorization", "key="+authKey)
 
 	start := time.Now()
 	resp, err := cli.http.Do(req)
+	if err != nil && ctx.Err() != nil {
+		drs := []goosh.DeviceResponse{}
+		for _, d := range devices {
+			m := msg
+			m.Token = d
+			drs = append(drs, goosh.CanceledResponse(m, ctx.Err()))
+		}
+		return drs, errors.Wrap(err, "push canceled")
+	}
 	if err != nil {
 		ps.instrumentError(599)
 		err = errors.Wrap(err, "couldn't make POST request to FCM")
 		wait := time.Now().Add(300 * time.Second)
-		dr.Error = &goosh.Error{
+		return fail(&goosh.Error{
 			Code:        500,
 			Description: "couldn't connect to FCM",
 			ShouldRetry: true,
 			RetryAt:     &wait,
-		}
-		dr.ShouldRetry = true
-		return dr, err
+		}, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 200 {
+		ps.known(authKey)
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			ps.instrumentError(422)
 			err = errors.Wrap(err, "couldn't read FCM response")
-			dr.Error = &goosh.Error{
+			return fail(&goosh.Error{
 				Code:        422,
 				Description: "couldn't read FCM response",
-			}
-			return dr, err
+			}, err)
 		}
 
+		if msg.Broadcast != "" {
+			return ps.broadcastResult(msg, body, start)
+		}
 		var fcmRes response
 		err = json.Unmarshal(body, &fcmRes)
 		if err != nil {
 			ps.instrumentError(422)
 			err = errors.Wrap(err, "couldn't unmarshal FCM response")
-			dr.Error = &goosh.Error{
+			return fail(&goosh.Error{
 				Code:        422,
 				Description: "couldn't parse FCM response",
-			}
-			return dr, err
+			}, err)
 		}
 
-		r := fcmRes.Results[0]
-		var e *goosh.Error
-		if !r.OK() {
-			e = &goosh.Error{}
-			e.Description = r.Error
-		}
-		dr.Delivered = r.OK()
-		dr.Error = e
 		ps.instrumentPush(time.Now().Sub(start))
-		return dr, nil
+		drs := zipResults(devices, fcmRes.Results)
+		for i := range drs {
+			drs[i].MulticastID = fcmRes.MulticastID
+			drs[i].SetTiming(start)
+		}
+		return drs, nil
 	} else if resp.StatusCode == 401 {
 		ps.instrumentError(resp.StatusCode)
-		dr.Error = &goosh.Error{
+		return fail(&goosh.Error{
 			Code:        401,
 			Description: "wrong api key",
-		}
-		return dr, errors.New("wrong API key")
+		}, errors.New("wrong API key"))
 	} else if resp.StatusCode == 400 {
 		ps.instrumentError(resp.StatusCode)
-		dr.Error = &goosh.Error{
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		reason := badRequestReason(body)
+		return fail(&goosh.Error{
 			Code:        400,
-			Description: "invalid payload, check JSON",
-		}
-		return dr, errors.New("invalid payload, check JSON")
+			Description: reason,
+		}, errors.New(reason))
 	} else if resp.StatusCode >= 500 {
 		ps.instrumentError(resp.StatusCode)
-		backoffLock.Lock()
-		waitUntil = time.Now()
-		retryAfter := resp.Header.Get("Retry-After")
-		if retryAfter != "" {
-			retryInt, err := strconv.Atoi(retryAfter)
-			if err == nil {
-				waitUntil.Add(time.Duration(retryInt) * time.Second)
-			}
-			if currentWait == 0 {
-				currentWait = initialBackoff
-			} else {
-				currentWait = minInt(currentWait*2, maxBackoff)
-			}
-			waitUntil = waitUntil.Add(time.Duration(currentWait) * time.Second)
-		}
-		untilCopy := waitUntil
-		backoffLock.Unlock()
-		dr.Error = &goosh.Error{
+		untilCopy := ps.backoffFrom(authKey, resp)
+		return fail(&goosh.Error{
 			Code:        int64(resp.StatusCode),
 			Description: "FCM error",
 			ShouldRetry: true,
 			RetryAt:     &untilCopy,
-		}
-		return dr, errors.New("FCM error")
+		}, errors.New("FCM error"))
 	}
 
 	ps.instrumentError(resp.StatusCode)
-	dr.Error = &goosh.Error{
+	return fail(&goosh.Error{
 		Code:        int64(resp.StatusCode),
 		Description: "Unknown response",
+	}, errors.New("Unknown response"))
+}
+
+// broadcastResult reads the response to a topic or condition push, which
+// carries a single numeric message_id rather than per-device results.
+func (ps *PushService) broadcastResult(msg goosh.Message, body []byte, start time.Time) ([]goosh.DeviceResponse, error) {
+	dr := goosh.DeviceResponse{Identifier: msg.Token}
+	var res topicResult
+	err := json.Unmarshal(body, &res)
+	if err != nil {
+		ps.instrumentError(422)
+		dr.Error = &goosh.Error{Code: 422, Description: "couldn't parse FCM response"}
+		return []goosh.DeviceResponse{dr}, errors.Wrap(err, "couldn't unmarshal FCM topic response")
+	}
+	if res.Error != "" {
+		dr.Error = &goosh.Error{Description: res.Error, ShouldRetry: transient(res.Error)}
+		dr.ShouldRetry = dr.Error.ShouldRetry
+		return []goosh.DeviceResponse{dr}, errors.New("FCM error: " + res.Error)
+	}
+	dr.Delivered = true
+	dr.MessageID = strconv.FormatInt(res.MessageID, 10)
+	dr.SetTiming(start)
+	ps.instrumentPush(time.Now().Sub(start))
+	return []goosh.DeviceResponse{dr}, nil
+}
+
+// unregistered tells whether an FCM error means the token is gone for good
+// and should be deleted. Both legacy and HTTP v1 error codes are known.
+func unregistered(reason string) bool {
+	switch reason {
+	case "NotRegistered", "InvalidRegistration", "MismatchSenderId", "UNREGISTERED", "SENDER_ID_MISMATCH":
+		return true
+	}
+	return false
+}
+
+// transient tells whether an FCM error is worth retrying.
+func transient(reason string) bool {
+	switch reason {
+	case "Unavailable", "InternalServerError", "DeviceMessageRateExceeded", "UNAVAILABLE", "INTERNAL", "QUOTA_EXCEEDED":
+		return true
 	}
-	return dr, errors.New("Unknown response")
+	return false
+}
+
+// zipResults pairs every device with its result, FCM returning one per
+// registration ID in the same order. Devices left without a result, as with
+// an empty results array, are reported as failed.
+func zipResults(devices []string, results []result) []goosh.DeviceResponse {
+	drs := make([]goosh.DeviceResponse, len(devices))
+	for i, d := range devices {
+		drs[i].Identifier = d
+		if i >= len(results) {
+			description := "missing FCM result"
+			if len(results) == 0 {
+				description = "empty FCM results"
+			}
+			drs[i].Error = &goosh.Error{
+				Code:        422,
+				Description: description,
+			}
+			continue
+		}
+		r := results[i]
+		drs[i].Canonical = r.RegistrationID
+		if !r.OK() {
+			drs[i].Error = &goosh.Error{Description: r.Error}
+			if unregistered(r.Error) {
+				drs[i].Unregistered = true
+			} else if transient(r.Error) {
+				drs[i].Error.ShouldRetry = true
+				drs[i].ShouldRetry = true
+			}
+			continue
+		}
+		drs[i].Delivered = true
+		drs[i].MessageID = r.MessageID
+	}
+	return drs
 }
 
 func (wr workRequest) Work() bool {
-	dr, err := wr.cli.push(wr.akey, wr.msg, wr.ps)
-	wr.res <- dr
+	defer wr.slots.Release()
+	if err := wr.ctx.Err(); err != nil {
+		wr.cancel(err)
+		return true
+	}
+	var drs []goosh.DeviceResponse
+	var err error
+	if wr.ts != nil {
+		var dr goosh.DeviceResponse
+		dr, err = wr.cli.pushV1(wr.ctx, wr.ts, wr.msg, wr.ps)
+		drs = []goosh.DeviceResponse{dr}
+	} else {
+		drs, err = wr.cli.push(wr.ctx, wr.akey, wr.msg, wr.devices, wr.ps)
+	}
+	for _, dr := range drs {
+		dr.Section = wr.msg.Section
+		wr.res <- dr
+	}
 	if err != nil {
-		log.Printf("Got an error sending push: %+v", err)
+		fields := []interface{}{"error", err, "service", goosh.ServiceFCM, "devices", len(drs)}
+		if len(drs) > 0 && drs[0].Error != nil {
+			fields = append(fields, "status", drs[0].Error.Code)
+		}
+		wr.ps.Log.Debug("Couldn't send push", fields...)
 		return false
 	}
 	return true
 }
 
-func composePayload(devices []string, payload json.RawMessage) ([]byte, error) {
+func composePayload(devices []string, payload json.RawMessage, msg goosh.Message) ([]byte, error) {
 	var parsed map[string]interface{}
 	err := json.Unmarshal(payload, &parsed)
 	if err != nil {
 		err = errors.Wrap(err, "couldn't unmarshal user payload")
 		return nil, err
 	}
-	parsed["registration_ids"] = devices
+	switch msg.Broadcast {
+	case goosh.BroadcastTopic:
+		parsed["to"] = msg.Token
+	case goosh.BroadcastCondition:
+		parsed["condition"] = msg.Token
+	default:
+		parsed["registration_ids"] = devices
+	}
+	if msg.TimeToLive != nil {
+		parsed["time_to_live"] = *msg.TimeToLive
+	}
+	if msg.FCMPriority != "" {
+		parsed["priority"] = msg.FCMPriority
+	}
+	if msg.DryRun {
+		parsed["dry_run"] = true
+	}
 
 	payloadB, err := json.Marshal(parsed)
 	if err != nil {
@@ -342,3 +918,41 @@ func minInt(x, y int64) int64 {
 	}
 	return y
 }
+
+// maxErrorBody is how much of an FCM error body is read.
+const maxErrorBody = 4096
+
+// badRequestReason tells why FCM answered with a 400. The reason is taken
+// from a JSON body carrying an error, as a string or in the HTTP v1 format,
+// or from a plain text one. It falls back to a generic description when
+// the body is empty or is JSON without a reason.
+func badRequestReason(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return "invalid payload, check JSON"
+	}
+	var parsed struct {
+		Error   json.RawMessage `json:"error"`
+		Results []result        `json:"results"`
+	}
+	if body[0] != '{' {
+		return string(body)
+	}
+	if json.Unmarshal(body, &parsed) != nil {
+		return "invalid payload, check JSON"
+	}
+	var reason string
+	var v1 v1Error
+	if json.Unmarshal(parsed.Error, &reason) == nil && reason != "" {
+		return reason
+	}
+	if json.Unmarshal(parsed.Error, &v1) == nil && v1.reason() != "" {
+		return v1.reason()
+	}
+	for _, res := range parsed.Results {
+		if res.Error != "" {
+			return res.Error
+		}
+	}
+	return "invalid payload, check JSON"
+}
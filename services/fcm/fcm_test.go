@@ -0,0 +1,210 @@
+package fcm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/michele/goosh"
+	"github.com/michele/goosh/worker"
+)
+
+// newTestService returns a PushService sending to handler, and a function
+// stopping it.
+func newTestService(t *testing.T, handler http.HandlerFunc) (*PushService, func()) {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	wg := worker.NewWorkerGroup(2)
+	wg.Start()
+	ps := NewPushService(wg.WorkQueue)
+	ps.URL = ts.URL
+	return ps, func() {
+		wg.Stop()
+		ts.Close()
+	}
+}
+
+func legacyRequest(authKey string, devices ...string) goosh.Request {
+	return goosh.Request{
+		FCMAuth: &goosh.FCMAuth{AuthKey: authKey},
+		Multiplexed: &goosh.Multiplexed{
+			Devices: devices,
+			Payload: json.RawMessage(`{"data":{"a":"b"}}`),
+		},
+	}
+}
+
+// v1Request returns a request pushing to devices through the v1 API of ps,
+// with a newly generated service account getting its tokens from /token.
+func v1Request(t *testing.T, ps *PushService, devices ...string) goosh.Request {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _ := json.Marshal(serviceAccount{
+		ProjectID:   "project",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		ClientEmail: "goosh@project.iam.gserviceaccount.com",
+		TokenURI:    ps.URL + "/token",
+	})
+	ps.V1BaseURL = ps.URL
+	r := legacyRequest("", devices...)
+	r.FCMAuth = &goosh.FCMAuth{ServiceAccount: string(account)}
+	return r
+}
+
+func TestRetryAfter(t *testing.T) {
+	date := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       time.Time
+	}{
+		{"seconds", "120", time.Now().Add(120 * time.Second)},
+		{"HTTP-date", date.Format(http.TimeFormat), date},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", test.retryAfter)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})
+			defer stop()
+			resp, _ := ps.Process(legacyRequest("key", "device"))
+			if len(resp.Devices) != 1 {
+				t.Fatalf("got %d devices, want 1", len(resp.Devices))
+			}
+			dr := resp.Devices[0]
+			if dr.Error == nil || dr.Error.Code != 503 || !dr.ShouldRetry {
+				t.Fatalf("got %+v, want a retriable 503", dr)
+			}
+			if dr.Error.RetryAt == nil {
+				t.Fatal("RetryAt isn't set")
+			}
+			// The first 5xx backs off for initialBackoff on top of Retry-After.
+			want := test.want.Add(initialBackoff * time.Second)
+			if d := dr.Error.RetryAt.Sub(want); d < -2*time.Second || d > 2*time.Second {
+				t.Fatalf("RetryAt is %v, want about %v", *dr.Error.RetryAt, want)
+			}
+			if !ps.ShouldWait("key") {
+				t.Fatal("ShouldWait is false for the key backing off")
+			}
+			if d := ps.RetryAfter("key") - time.Until(*dr.Error.RetryAt); d < -2*time.Second || d > 2*time.Second {
+				t.Fatalf("RetryAfter is %s, want about %s", ps.RetryAfter("key"), time.Until(*dr.Error.RetryAt))
+			}
+			if ps.ShouldWait("other") || ps.RetryAfter("other") != 0 {
+				t.Fatal("another key backs off too")
+			}
+		})
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+		case "/v1/projects/project/messages:send":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"name":"projects/project/messages/0:v1"}`))
+		default:
+			w.Write([]byte(`{"multicast_id":42,"success":2,"failure":0,"results":[{"message_id":"0:first"},{"message_id":"0:second"}]}`))
+		}
+	})
+	defer stop()
+
+	resp, err := ps.Process(legacyRequest("key", "first", "second"))
+	if err != nil || len(resp.Devices) != 2 {
+		t.Fatalf("legacy push got %+v, %v", resp.Devices, err)
+	}
+	for _, dr := range resp.Devices {
+		if want := "0:" + dr.Identifier; dr.MessageID != want || dr.MulticastID != 42 {
+			t.Fatalf("legacy push got message ID %q and multicast ID %d, want %q and 42", dr.MessageID, dr.MulticastID, want)
+		}
+	}
+
+	resp, err = ps.Process(v1Request(t, ps, "device"))
+	if err != nil || len(resp.Devices) != 1 {
+		t.Fatalf("v1 push got %+v, %v", resp.Devices, err)
+	}
+	if dr := resp.Devices[0]; dr.MessageID != "projects/project/messages/0:v1" {
+		t.Fatalf("v1 push got message ID %q, want the message name", dr.MessageID)
+	}
+}
+
+func TestBackingOff(t *testing.T) {
+	ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "key=failing" {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"multicast_id":1,"success":1,"failure":0,"results":[{"message_id":"0:id"}]}`))
+	})
+	defer stop()
+	if ps.BackingOff() {
+		t.Fatal("BackingOff is true before any push")
+	}
+	ps.Process(legacyRequest("failing", "device"))
+	if !ps.BackingOff() {
+		t.Fatal("BackingOff is false with the only key backing off")
+	}
+	ps.Process(legacyRequest("working", "device"))
+	if ps.BackingOff() {
+		t.Fatal("BackingOff is true with a key that isn't backing off")
+	}
+}
+
+func TestV1ServerErrorShouldRetry(t *testing.T) {
+	ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer stop()
+	resp, _ := ps.Process(v1Request(t, ps, "device"))
+	if len(resp.Devices) != 1 {
+		t.Fatalf("got %d devices, want 1", len(resp.Devices))
+	}
+	if dr := resp.Devices[0]; !dr.ShouldRetry || dr.Error == nil || !dr.Error.ShouldRetry {
+		t.Fatalf("a v1 500 got %+v, want it flagged for retry", dr)
+	}
+}
+
+func TestV1TokenFetchHonorsContext(t *testing.T) {
+	release := make(chan bool)
+	ps, stop := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer stop()
+	defer close(release)
+	r := v1Request(t, ps, "device")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan goosh.Response, 1)
+	go func() {
+		resp, _ := ps.ProcessContext(ctx, r)
+		done <- resp
+	}()
+	select {
+	case resp := <-done:
+		if len(resp.Devices) != 1 || resp.Devices[0].Error == nil || resp.Devices[0].Delivered {
+			t.Fatalf("got %+v, want the push canceled", resp.Devices)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the token fetch ignored the context")
+	}
+}
@@ -0,0 +1,429 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michele/goosh"
+	"github.com/pkg/errors"
+)
+
+const (
+	v1BaseURL       = "https://fcm.googleapis.com"
+	v1Scope         = "https://www.googleapis.com/auth/firebase.messaging"
+	defaultTokenURI = "https://oauth2.googleapis.com/token"
+	// tokenRefreshMargin is how long before expiry an access token is
+	// considered stale and refreshed.
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+var (
+	ErrInvalidServiceAccount = errors.New("invalid FCM service account")
+	ErrMissingProjectID      = errors.New("missing FCM project ID")
+)
+
+type serviceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// tokenSource exchanges a service account's signed assertion for an OAuth2
+// access token and caches it until it's about to expire.
+type tokenSource struct {
+	account   serviceAccount
+	projectID string
+	key       *rsa.PrivateKey
+	lock      sync.Mutex
+	token     string
+	expiry    time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type v1Response struct {
+	Name  string   `json:"name"`
+	Error *v1Error `json:"error,omitempty"`
+}
+
+type v1Error struct {
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+	Details []struct {
+		Type      string `json:"@type"`
+		ErrorCode string `json:"errorCode"`
+	} `json:"details"`
+}
+
+// reason returns FCM's own error code when present, the status otherwise.
+func (e *v1Error) reason() string {
+	for _, d := range e.Details {
+		if d.ErrorCode != "" {
+			return d.ErrorCode
+		}
+	}
+	if e.Status != "" {
+		return e.Status
+	}
+	return e.Message
+}
+
+func newTokenSource(auth goosh.FCMAuth) (*tokenSource, error) {
+	raw := []byte(auth.ServiceAccount)
+	if !strings.HasPrefix(strings.TrimSpace(auth.ServiceAccount), "{") {
+		decoded, err := base64.StdEncoding.DecodeString(auth.ServiceAccount)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't decode FCM service account")
+		}
+		raw = decoded
+	}
+	ts := &tokenSource{}
+	err := json.Unmarshal(raw, &ts.account)
+	if err != nil || ts.account.ClientEmail == "" || ts.account.PrivateKey == "" {
+		return nil, ErrInvalidServiceAccount
+	}
+	if ts.account.TokenURI == "" {
+		ts.account.TokenURI = defaultTokenURI
+	}
+	ts.projectID = auth.ProjectID
+	if ts.projectID == "" {
+		ts.projectID = ts.account.ProjectID
+	}
+	if ts.projectID == "" {
+		return nil, ErrMissingProjectID
+	}
+	block, _ := pem.Decode([]byte(ts.account.PrivateKey))
+	if block == nil {
+		return nil, ErrInvalidServiceAccount
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, ErrInvalidServiceAccount
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidServiceAccount
+	}
+	ts.key = key
+	return ts, nil
+}
+
+// Token returns a valid access token, fetching a new one when needed. The
+// fetch is given up on when ctx is done.
+func (ts *tokenSource) Token(ctx context.Context, hc *http.Client) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.token != "" && time.Now().Add(tokenRefreshMargin).Before(ts.expiry) {
+		return ts.token, nil
+	}
+	assertion, err := ts.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't build OAuth2 token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't request OAuth2 token")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't read OAuth2 token response")
+	}
+	if resp.StatusCode != 200 {
+		return "", errors.Errorf("OAuth2 token request failed [%d]: %s", resp.StatusCode, string(body))
+	}
+	var tr tokenResponse
+	err = json.Unmarshal(body, &tr)
+	if err != nil || tr.AccessToken == "" {
+		return "", errors.New("couldn't parse OAuth2 token response")
+	}
+	ts.token = tr.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// Reset drops the cached access token so the next call to Token fetches a
+// new one.
+func (ts *tokenSource) Reset() {
+	ts.lock.Lock()
+	ts.token = ""
+	ts.lock.Unlock()
+}
+
+func (ts *tokenSource) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": ts.account.PrivateKeyID})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal JWT header")
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   ts.account.ClientEmail,
+		"scope": v1Scope,
+		"aud":   ts.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't marshal JWT claims")
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't sign JWT")
+	}
+	return input + "." + enc.EncodeToString(sig), nil
+}
+
+func (ps *PushService) tokenSource(auth goosh.FCMAuth) (*tokenSource, error) {
+	key := auth.ServiceAccount + auth.ProjectID
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ts, ok := ps.tokens[key]; ok {
+		return ts, nil
+	}
+	ts, err := newTokenSource(auth)
+	if err != nil {
+		return nil, err
+	}
+	ps.tokens[key] = ts
+	return ts, nil
+}
+
+// composeV1Payload turns a legacy-style payload into an HTTP v1 message for a
+// single token, topic or condition. Payloads that already carry a "message"
+// object are used as is. Legacy top-level options are moved under "android",
+// and data values are converted to strings since v1 doesn't accept anything
+// else.
+func composeV1Payload(msg goosh.Message, payload json.RawMessage) ([]byte, error) {
+	var parsed map[string]interface{}
+	err := json.Unmarshal(payload, &parsed)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't unmarshal user payload")
+	}
+	message, ok := parsed["message"].(map[string]interface{})
+	if !ok {
+		message = map[string]interface{}{}
+		android, _ := parsed["android"].(map[string]interface{})
+		if android == nil {
+			android = map[string]interface{}{}
+		}
+		for k, v := range parsed {
+			switch k {
+			case "notification", "apns", "webpush", "fcm_options":
+				message[k] = v
+			case "data":
+				data, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, errors.New("data must be an object")
+				}
+				message["data"] = stringifyValues(data)
+			case "priority":
+				if p, ok := v.(string); ok {
+					android["priority"] = strings.ToUpper(p)
+				}
+			case "time_to_live":
+				if ttl, ok := v.(float64); ok {
+					android["ttl"] = fmt.Sprintf("%ds", int64(ttl))
+				}
+			case "collapse_key", "restricted_package_name":
+				android[k] = v
+			}
+		}
+		if len(android) > 0 {
+			message["android"] = android
+		}
+	}
+	if msg.TimeToLive != nil || msg.FCMPriority != "" {
+		android, _ := message["android"].(map[string]interface{})
+		if android == nil {
+			android = map[string]interface{}{}
+		}
+		if msg.TimeToLive != nil {
+			android["ttl"] = fmt.Sprintf("%ds", *msg.TimeToLive)
+		}
+		if msg.FCMPriority != "" {
+			android["priority"] = strings.ToUpper(msg.FCMPriority)
+		}
+		message["android"] = android
+	}
+	delete(message, "token")
+	delete(message, "topic")
+	delete(message, "condition")
+	switch msg.Broadcast {
+	case goosh.BroadcastTopic:
+		message["topic"] = strings.TrimPrefix(msg.Token, "/topics/")
+	case goosh.BroadcastCondition:
+		message["condition"] = msg.Token
+	default:
+		message["token"] = msg.Token
+	}
+	body := map[string]interface{}{"message": message}
+	if msg.DryRun {
+		body["validate_only"] = true
+	}
+	payloadB, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't marshal payload for FCM")
+	}
+	return payloadB, nil
+}
+
+func stringifyValues(data map[string]interface{}) map[string]string {
+	out := map[string]string{}
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			out[k] = s
+			continue
+		}
+		b, _ := json.Marshal(v)
+		out[k] = string(b)
+	}
+	return out
+}
+
+func (ps *PushService) v1URL(projectID string) string {
+	return strings.TrimRight(ps.V1BaseURL, "/") + "/v1/projects/" + url.PathEscape(projectID) + "/messages:send"
+}
+
+func (cli *client) pushV1(ctx context.Context, ts *tokenSource, msg goosh.Message, ps *PushService) (goosh.DeviceResponse, error) {
+	dr := goosh.DeviceResponse{Identifier: msg.Token}
+	payload, perr, err := ps.preparePayload(msg.Payload)
+	if err != nil {
+		dr.Error = perr
+		return dr, err
+	}
+	payloadB, err := composeV1Payload(msg, payload)
+	if err != nil {
+		err = errors.Wrap(err, "composeV1Payload returned an error")
+		dr.Error = &goosh.Error{
+			Code:        422,
+			Description: "(pre-validation) invalid payload",
+		}
+		return dr, err
+	}
+	reqCtx, cancel := ps.requestContext(ctx)
+	defer cancel()
+	bearer, err := ts.Token(reqCtx, cli.http)
+	if err != nil && ctx.Err() != nil {
+		return goosh.CanceledResponse(msg, ctx.Err()), errors.Wrap(err, "push canceled")
+	}
+	if err != nil {
+		ps.instrumentError(401)
+		err = errors.Wrap(err, "couldn't get FCM access token")
+		wait := time.Now().Add(300 * time.Second)
+		dr.Error = &goosh.Error{
+			Code:        401,
+			Description: "couldn't get FCM access token",
+			ShouldRetry: true,
+			RetryAt:     &wait,
+		}
+		dr.ShouldRetry = true
+		return dr, err
+	}
+	req, err := http.NewRequestWithContext(reqCtx, "POST", ps.v1URL(ts.projectID), ioutil.NopCloser(bytes.NewBuffer(payloadB)))
+	if err != nil {
+		err = errors.Wrap(err, "couldn't build FCM request")
+		dr.Error = &goosh.Error{
+			Code:        500,
+			Description: "couldn't build request",
+		}
+		return dr, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+bearer)
+
+	start := time.Now()
+	resp, err := cli.http.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return goosh.CanceledResponse(msg, ctx.Err()), errors.Wrap(err, "push canceled")
+	}
+	if err != nil {
+		ps.instrumentError(599)
+		err = errors.Wrap(err, "couldn't make POST request to FCM")
+		wait := time.Now().Add(300 * time.Second)
+		dr.Error = &goosh.Error{
+			Code:        500,
+			Description: "couldn't connect to FCM",
+			ShouldRetry: true,
+			RetryAt:     &wait,
+		}
+		dr.ShouldRetry = true
+		return dr, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ps.instrumentError(422)
+		err = errors.Wrap(err, "couldn't read FCM response")
+		dr.Error = &goosh.Error{
+			Code:        422,
+			Description: "couldn't read FCM response",
+		}
+		return dr, err
+	}
+	var fcmRes v1Response
+	json.Unmarshal(body, &fcmRes)
+	if resp.StatusCode == 200 {
+		ps.known(ts.projectID)
+		dr.Delivered = true
+		dr.MessageID = fcmRes.Name
+		dr.SetTiming(start)
+		ps.instrumentPush(time.Now().Sub(start))
+		return dr, nil
+	}
+	ps.instrumentError(resp.StatusCode)
+	dr.Error = &goosh.Error{
+		Code:        int64(resp.StatusCode),
+		Description: "FCM error",
+	}
+	if fcmRes.Error != nil {
+		dr.Error.Description = fcmRes.Error.reason()
+	}
+	if unregistered(dr.Error.Description) {
+		dr.Unregistered = true
+		return dr, errors.New("FCM error: " + dr.Error.Description)
+	}
+	if resp.StatusCode == 401 {
+		ts.Reset()
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+		until := ps.backoffFrom(ts.projectID, resp)
+		dr.Error.ShouldRetry = true
+		dr.Error.RetryAt = &until
+		dr.ShouldRetry = true
+	}
+	return dr, errors.New("FCM error: " + dr.Error.Description)
+}
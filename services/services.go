@@ -0,0 +1,40 @@
+// Package services wires the APNS and FCM push services into a
+// goosh.Dispatcher, to embed goosh without its HTTP server.
+package services
+
+import (
+	"github.com/michele/goosh"
+	"github.com/michele/goosh/services/apns2"
+	"github.com/michele/goosh/services/fcm"
+	"github.com/michele/goosh/worker"
+)
+
+// NewDispatcher starts a group of workers and returns a Dispatcher sending
+// through the APNS and FCM services, both logging to log. The services can
+// be further configured through the APNS and FCM fields of the Dispatcher,
+// which are an *apns2.PushService and an *fcm.PushService. Call Stop to
+// drain the workers.
+func NewDispatcher(workers int, log goosh.Logger) *goosh.Dispatcher {
+	wg := worker.NewWorkerGroup(workers)
+	apns := apns2.NewPushService(wg.WorkQueue)
+	fcm := fcm.NewPushService(wg.WorkQueue)
+	apns.Log = log
+	fcm.Log = log
+	apns.Workers = wg
+	fcm.Workers = wg
+	wg.Start()
+	d := goosh.NewDispatcher(apns, fcm)
+	d.Workers = wg
+	d.Log = log
+	return d
+}
+
+// EnvError returns why the environment overriding the APNS host or the FCM
+// URL couldn't be used, if it couldn't. The services fall back to their
+// defaults, which a server is better off not doing silently.
+func EnvError() error {
+	if err := apns2.EnvError(); err != nil {
+		return err
+	}
+	return fcm.EnvError()
+}
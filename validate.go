@@ -0,0 +1,131 @@
+package goosh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationError is returned by Request.Validate. Problems lists
+// everything wrong with the request.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid request: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks that the request can be sent: it needs credentials for
+// the platforms it targets, devices, and payloads that are JSON objects.
+// Mixed requests must address each platform's devices through its targets.
+func (r *Request) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if r.APNSAuth == nil && r.FCMAuth == nil {
+		add("missing apns or fcm credentials")
+	}
+	if a := r.APNSAuth; a != nil {
+		if a.UsesToken() {
+			if a.KeyID == "" || a.TeamID == "" || a.Topic == "" {
+				add("apns token authentication needs key_id, team_id and topic")
+			}
+		} else if a.Certificate == "" {
+			add("apns credentials need a certificate or an auth_key")
+		}
+	}
+	if a := r.FCMAuth; a != nil {
+		if a.AuthKey == "" && !a.UsesV1() && len(a.DeviceAuthKeys) == 0 {
+			add("fcm credentials need an auth_key or a service_account")
+		}
+		if err := a.ValidateOptions(); err != nil {
+			add("%s", err.Error())
+		}
+	}
+	if r.Timeout < 0 {
+		add("timeout can't be negative")
+	}
+	if r.APNSTargets != nil && r.APNSAuth == nil {
+		add("apns_targets without apns credentials")
+	}
+	if r.FCMTargets != nil && r.FCMAuth == nil {
+		add("fcm_targets without fcm credentials")
+	}
+	if r.IsMixed() && (r.Multiplexed != nil || r.Batched != nil) {
+		add("mixed requests must list devices in apns_targets and fcm_targets")
+	}
+
+	validateDevices := func(name string, multi *Multiplexed, batched *Batched) {
+		if multi != nil {
+			if len(multi.Devices) == 0 {
+				add("%smultiplexed has no devices", name)
+			}
+			for _, d := range multi.Devices {
+				if d == "" {
+					add("%smultiplexed has an empty device token", name)
+					break
+				}
+			}
+			if !isJSONObject(multi.Payload) {
+				add("%smultiplexed payload isn't a JSON object", name)
+			}
+		}
+		if batched != nil {
+			if len(*batched) == 0 {
+				add("%sbatched has no devices", name)
+			}
+			devices := make([]string, 0, len(*batched))
+			for d := range *batched {
+				devices = append(devices, d)
+			}
+			sort.Strings(devices)
+			for _, d := range devices {
+				if d == "" {
+					add("%sbatched has an empty device token", name)
+				} else if !isJSONObject((*batched)[d]) {
+					add("%sbatched payload of %s isn't a JSON object", name, d)
+				}
+			}
+		}
+	}
+	validateDevices("", r.Multiplexed, r.Batched)
+	if t := r.APNSTargets; t != nil {
+		validateDevices("apns_targets.", t.Multiplexed, t.Batched)
+	}
+	if t := r.FCMTargets; t != nil {
+		validateDevices("fcm_targets.", t.Multiplexed, t.Batched)
+	}
+
+	if b := r.Broadcast; b != nil {
+		if r.FCMAuth == nil {
+			add("broadcast without fcm credentials")
+		}
+		if (b.Topic == "") == (b.Condition == "") {
+			add("broadcast needs either a topic or a condition")
+		}
+		if !isJSONObject(b.Payload) {
+			add("broadcast payload isn't a JSON object")
+		}
+	}
+
+	if len(problems) == 0 {
+		apns, fcm := r.Split()
+		if apns == nil && fcm == nil {
+			add("request doesn't target any device")
+		}
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func isJSONObject(payload json.RawMessage) bool {
+	p := bytes.TrimSpace(payload)
+	return len(p) > 0 && p[0] == '{' && json.Valid(p)
+}
@@ -0,0 +1,31 @@
+// Package version holds the build information of goosh. Its variables are
+// set when linking, see the build target of the Makefile:
+//
+//	go build -ldflags "-X github.com/michele/goosh/version.Commit=..."
+package version
+
+import "runtime"
+
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildTime = ""
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the Info of the running build.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"container/heap"
+	"time"
+)
+
+// delayed is a job waiting in the delay queue until at.
+type delayed struct {
+	at   time.Time
+	work WorkRequest
+}
+
+// delayHeap orders the delayed jobs by time, the earliest first.
+type delayHeap []delayed
+
+func (h delayHeap) Len() int            { return len(h) }
+func (h delayHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h delayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(delayed)) }
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
+
+// EnqueueAt queues w once at is reached. Until then it waits in a delay
+// queue rather than on a worker. Jobs still waiting when the group is
+// stopped are dropped.
+func (wg *WorkerGroup) EnqueueAt(w WorkRequest, at time.Time) bool {
+	wg.sendLock.Lock()
+	closed := wg.closed
+	wg.sendLock.Unlock()
+	if closed {
+		return false
+	}
+	wg.delayLock.Lock()
+	heap.Push(&wg.delays, delayed{at: at, work: w})
+	if !wg.delaying {
+		wg.delaying = true
+		go wg.runDelays()
+	}
+	wg.delayLock.Unlock()
+	select {
+	case wg.delayWake <- true:
+	default:
+	}
+	return true
+}
+
+// Delayed returns how many jobs are waiting in the delay queue.
+func (wg *WorkerGroup) Delayed() int {
+	wg.delayLock.Lock()
+	defer wg.delayLock.Unlock()
+	return len(wg.delays)
+}
+
+// runDelays moves the delayed jobs to the WorkQueue as they come due, until
+// the group is stopped.
+func (wg *WorkerGroup) runDelays() {
+	for {
+		wg.delayLock.Lock()
+		if len(wg.delays) == 0 {
+			wg.delayLock.Unlock()
+			select {
+			case <-wg.delayWake:
+				continue
+			case <-wg.gone:
+				return
+			}
+		}
+		wait := time.Until(wg.delays[0].at)
+		if wait <= 0 {
+			d := heap.Pop(&wg.delays).(delayed)
+			wg.delayLock.Unlock()
+			wg.Enqueue(d.work)
+			continue
+		}
+		wg.delayLock.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-wg.delayWake:
+			timer.Stop()
+		case <-wg.gone:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -1,9 +1,20 @@
 package worker
 
 import (
+	"context"
+	"log"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
+// ErrStopped is returned by Send once the group no longer reads its
+// WorkQueue.
+var ErrStopped = errors.New("worker group stopped")
+
 type WorkRequest interface {
 	Work() bool
 }
@@ -14,15 +25,59 @@ type Worker struct {
 	WorkerQueue chan chan WorkRequest
 	Quit        chan bool
 	wait        *sync.WaitGroup
+	counters    *counters
+}
+
+// counters are updated atomically by the workers of a group.
+type counters struct {
+	busy      int64
+	processed uint64
+}
+
+// Stats is a snapshot of a WorkerGroup's activity. Processed counts every
+// job run since the group was created.
+type Stats struct {
+	Busy      int
+	Queued    int
+	Processed uint64
 }
 
 type WorkerGroup struct {
+	// counters comes first to keep its 64-bit fields aligned for atomic
+	// access on 32-bit platforms.
+	counters    counters
 	WorkerQueue chan chan WorkRequest
 	WorkQueue   chan WorkRequest
 	workers     []*Worker
 	wait        *sync.WaitGroup
 	closed      bool
 	quit        chan bool
+	started     bool
+	stopped     chan bool
+	lock        sync.Mutex
+	// drain is closed by StopContext to have the dispatcher hand out the
+	// rest of the WorkQueue, until drainCtx is done, before quitting.
+	drain    chan bool
+	drainCtx context.Context
+
+	// sendLock guards closed for the Enqueue methods, which register their
+	// pending sends in senders. gone is closed once nothing reads the
+	// WorkQueue anymore, so that those sends give up.
+	sendLock sync.Mutex
+	senders  sync.WaitGroup
+	gone     chan bool
+	// backlog holds the jobs of Enqueue that didn't fit in the WorkQueue.
+	// A single feedBacklog goroutine, running while feeding is set, moves
+	// them there oldest first.
+	backlog []WorkRequest
+	feeding bool
+
+	// delays holds the jobs of EnqueueAt until they're due. runDelays is
+	// started with the first of them and woken by delayWake.
+	delayLock sync.Mutex
+	delays    delayHeap
+	delaying  bool
+	delayWake chan bool
 }
 
 func NewWorker(id int, wq chan chan WorkRequest, wait *sync.WaitGroup) *Worker {
@@ -41,11 +96,15 @@ func (w *Worker) Start() {
 	go func() {
 		defer w.wait.Done()
 		for {
-			w.WorkerQueue <- w.Work
+			select {
+			case w.WorkerQueue <- w.Work:
+			case <-w.Quit:
+				return
+			}
 
 			select {
 			case work := <-w.Work:
-				work.Work()
+				w.run(work)
 			case <-w.Quit:
 				return
 			}
@@ -53,6 +112,25 @@ func (w *Worker) Start() {
 	}()
 }
 
+// run does the work, recovering from a panic so that the worker survives
+// it. A job that panicked counts as failed.
+func (w *Worker) run(work WorkRequest) (ok bool) {
+	if w.counters != nil {
+		atomic.AddInt64(&w.counters.busy, 1)
+		defer func() {
+			atomic.AddInt64(&w.counters.busy, -1)
+			atomic.AddUint64(&w.counters.processed, 1)
+		}()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Worker %d recovered from a panic running %T: %v\n%s", w.ID, work, r, debug.Stack())
+			ok = false
+		}
+	}()
+	return work.Work()
+}
+
 func (w *Worker) Stop() {
 	go func() {
 		close(w.Quit)
@@ -63,55 +141,341 @@ func NewWorkerGroup(n int) (wg *WorkerGroup) {
 	wg = &WorkerGroup{}
 	wg.WorkerQueue = make(chan chan WorkRequest, n)
 	wg.WorkQueue = make(chan WorkRequest, n*2)
-	wg.workers = make([]*Worker, n)
 	wg.quit = make(chan bool)
+	wg.drain = make(chan bool)
+	wg.gone = make(chan bool)
+	wg.delayWake = make(chan bool, 1)
 	wg.wait = &sync.WaitGroup{}
+	wg.startWorkers(n)
+	return wg
+}
+
+func (wg *WorkerGroup) startWorkers(n int) {
+	wg.workers = nil
+	wg.addWorkers(n)
+}
+
+func (wg *WorkerGroup) addWorkers(n int) {
+	id := 0
+	if len(wg.workers) > 0 {
+		id = wg.workers[len(wg.workers)-1].ID
+	}
 	wg.wait.Add(n)
 	for i := 0; i < n; i++ {
-		w := NewWorker(i+1, wg.WorkerQueue, wg.wait)
-		wg.workers[i] = w
+		id++
+		w := NewWorker(id, wg.WorkerQueue, wg.wait)
+		w.counters = &wg.counters
+		wg.workers = append(wg.workers, w)
 		w.Start()
 	}
-	return wg
+}
+
+// Resize grows or shrinks the group to n workers, at least one. Surplus
+// workers are only stopped once idle, so shrinking waits for as many
+// running jobs as needed to finish.
+func (wg *WorkerGroup) Resize(n int) {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	if wg.closed {
+		return
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > len(wg.workers) {
+		wg.addWorkers(n - len(wg.workers))
+		return
+	}
+	for len(wg.workers) > n {
+		// Workers only offer their Work channel when idle, and taking it
+		// keeps the dispatcher from handing them anything else.
+		work := <-wg.WorkerQueue
+		for i, w := range wg.workers {
+			if w.Work == work {
+				w.Stop()
+				wg.workers = append(wg.workers[:i], wg.workers[i+1:]...)
+				break
+			}
+		}
+	}
 }
 
 func (wg *WorkerGroup) Start() {
+	wg.started = true
+	quit := wg.quit
+	drain := wg.drain
+	stopped := make(chan bool)
+	wg.stopped = stopped
 	go func() {
+		defer close(stopped)
 		for {
 			select {
 			case work := <-wg.WorkQueue:
-				go func() {
-					worker := <-wg.WorkerQueue
+				// Waiting for a free worker here, rather than in a goroutine,
+				// keeps the backlog in WorkQueue so that it can fill up.
+				worker := <-wg.WorkerQueue
+				worker <- work
+			case <-drain:
+				wg.drainQueue(wg.drainCtx, wg.sendersDone())
+				return
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
 
-					worker <- work
-				}()
-			case <-wg.quit:
+// drainQueue hands every job left in the WorkQueue to a worker, including
+// the ones still being sent by Enqueue, giving up when ctx is done.
+func (wg *WorkerGroup) drainQueue(ctx context.Context, sendersDone <-chan bool) {
+	for {
+		var work WorkRequest
+		select {
+		case work = <-wg.WorkQueue:
+		case <-sendersDone:
+			// Nothing else is coming, whatever is left is already queued.
+			select {
+			case work = <-wg.WorkQueue:
+			default:
 				return
 			}
+		case <-ctx.Done():
+			return
 		}
+		select {
+		case worker := <-wg.WorkerQueue:
+			worker <- work
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendersDone returns a channel closed once every pending Enqueue is done.
+func (wg *WorkerGroup) sendersDone() <-chan bool {
+	done := make(chan bool)
+	go func() {
+		wg.senders.Wait()
+		close(done)
 	}()
+	return done
+}
+
+// register records a pending send, unless the group is closed.
+func (wg *WorkerGroup) register() bool {
+	wg.sendLock.Lock()
+	defer wg.sendLock.Unlock()
+	if wg.closed {
+		return false
+	}
+	wg.senders.Add(1)
+	return true
 }
 
+// Enqueue queues w without blocking. When the WorkQueue is full, w waits in
+// the backlog instead, behind the jobs already there.
 func (wg *WorkerGroup) Enqueue(w WorkRequest) bool {
+	wg.sendLock.Lock()
+	defer wg.sendLock.Unlock()
 	if wg.closed {
 		return false
 	}
-	go func() {
-		wg.WorkQueue <- w
-	}()
+	if len(wg.backlog) == 0 {
+		select {
+		case wg.WorkQueue <- w:
+			return true
+		default:
+		}
+	}
+	wg.senders.Add(1)
+	wg.backlog = append(wg.backlog, w)
+	if !wg.feeding {
+		wg.feeding = true
+		go wg.feedBacklog()
+	}
 	return true
 }
 
-func (wg *WorkerGroup) Stop() {
+// feedBacklog moves the backlog to the WorkQueue until it's empty, dropping
+// the jobs left once nothing reads the WorkQueue anymore.
+func (wg *WorkerGroup) feedBacklog() {
+	for {
+		wg.sendLock.Lock()
+		if len(wg.backlog) == 0 {
+			wg.feeding = false
+			wg.sendLock.Unlock()
+			return
+		}
+		w := wg.backlog[0]
+		wg.backlog[0] = nil
+		wg.backlog = wg.backlog[1:]
+		wg.sendLock.Unlock()
+		select {
+		case wg.WorkQueue <- w:
+		case <-wg.gone:
+		}
+		wg.senders.Done()
+	}
+}
+
+// AddProducer registers a producer about to send jobs to the WorkQueue
+// through Send, like a push service fanning out the devices of a request.
+// StopContext keeps draining the WorkQueue until every producer called
+// ProducerDone. It returns false once the group is stopping, in which case
+// nothing should be sent.
+func (wg *WorkerGroup) AddProducer() bool {
+	return wg.register()
+}
+
+// ProducerDone tells that a producer registered by AddProducer won't send
+// anything else.
+func (wg *WorkerGroup) ProducerDone() {
+	wg.senders.Done()
+}
+
+// Send queues w for a registered producer, waiting for room until ctx is
+// done or the group stops reading the WorkQueue.
+func (wg *WorkerGroup) Send(ctx context.Context, w WorkRequest) error {
+	// The WorkQueue may have room left after the group stopped.
+	select {
+	case <-wg.gone:
+		return ErrStopped
+	default:
+	}
+	select {
+	case wg.WorkQueue <- w:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wg.gone:
+		return ErrStopped
+	}
+}
+
+// TryEnqueue queues w unless the WorkQueue is full, in which case it
+// returns false right away.
+func (wg *WorkerGroup) TryEnqueue(w WorkRequest) bool {
+	if !wg.register() {
+		return false
+	}
+	defer wg.senders.Done()
+	select {
+	case wg.WorkQueue <- w:
+		return true
+	default:
+		return false
+	}
+}
+
+// EnqueueWithTimeout queues w, waiting at most d for room in the WorkQueue.
+func (wg *WorkerGroup) EnqueueWithTimeout(w WorkRequest, d time.Duration) bool {
+	if !wg.register() {
+		return false
+	}
+	defer wg.senders.Done()
+	select {
+	case wg.WorkQueue <- w:
+		return true
+	case <-time.After(d):
+		return false
+	case <-wg.gone:
+		return false
+	}
+}
+
+// Saturated tells whether the WorkQueue is full, meaning every worker is
+// busy and new work would have to wait.
+func (wg *WorkerGroup) Saturated() bool {
+	return len(wg.WorkQueue) >= cap(wg.WorkQueue)
+}
+
+// Stats reports how many workers are busy, how many jobs are waiting in the
+// WorkQueue and how many were processed so far.
+func (wg *WorkerGroup) Stats() Stats {
+	return Stats{
+		Busy:      int(atomic.LoadInt64(&wg.counters.busy)),
+		Queued:    len(wg.WorkQueue),
+		Processed: atomic.LoadUint64(&wg.counters.processed),
+	}
+}
+
+// Restart replaces every worker with a fresh one without losing work. It
+// waits for the jobs already handed to workers to finish, then starts new
+// workers that resume from the same WorkQueue, which is left open.
+func (wg *WorkerGroup) Restart() {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
 	if wg.closed {
 		return
 	}
+	// The dispatcher hands the job it's holding to a worker before quitting,
+	// so the workers must only be stopped after it's done.
 	close(wg.quit)
-	wg.closed = true
+	if wg.started {
+		<-wg.stopped
+	}
 	for _, w := range wg.workers {
 		w.Stop()
 	}
 	wg.wait.Wait()
-	close(wg.WorkQueue)
+	// Stopped workers leave their Work channel behind in WorkerQueue.
+	for drained := false; !drained; {
+		select {
+		case <-wg.WorkerQueue:
+		default:
+			drained = true
+		}
+	}
+	wg.quit = make(chan bool)
+	wg.startWorkers(len(wg.workers))
+	if wg.started {
+		wg.Start()
+	}
+}
+
+// Stop stops accepting work and waits for the jobs already queued and
+// running to finish. See StopContext.
+func (wg *WorkerGroup) Stop() {
+	wg.StopContext(context.Background())
+}
+
+// StopContext stops accepting work, then waits for the jobs already queued
+// and running to finish before stopping the workers. When ctx is done first,
+// the jobs still queued are dropped and ctx's error is returned.
+//
+// The WorkQueue is never closed. Producers sending to it should go through
+// AddProducer and Send, which the drain waits for; plain sends made to it
+// after Stop never get processed.
+func (wg *WorkerGroup) StopContext(ctx context.Context) error {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	wg.sendLock.Lock()
+	if wg.closed {
+		wg.sendLock.Unlock()
+		return nil
+	}
+	wg.closed = true
+	wg.sendLock.Unlock()
+	if wg.started {
+		wg.drainCtx = ctx
+		close(wg.drain)
+		<-wg.stopped
+	}
+	close(wg.gone)
+	for _, w := range wg.workers {
+		w.Stop()
+	}
+	done := make(chan bool)
+	go func() {
+		wg.wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	close(wg.quit)
 	close(wg.WorkerQueue)
+	return nil
 }
@@ -0,0 +1,152 @@
+package worker
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type workFunc func() bool
+
+func (f workFunc) Work() bool {
+	return f()
+}
+
+func TestStopWaitsForProducers(t *testing.T) {
+	wg := NewWorkerGroup(1)
+	wg.Start()
+	if !wg.AddProducer() {
+		t.Fatal("AddProducer refused before Stop")
+	}
+	stopped := make(chan bool)
+	go func() {
+		wg.Stop()
+		close(stopped)
+	}()
+	// Let Stop start draining before the producer sends anything.
+	time.Sleep(50 * time.Millisecond)
+	if wg.AddProducer() {
+		t.Fatal("AddProducer accepted while stopping")
+	}
+	var ran int64
+	for i := 0; i < 10; i++ {
+		err := wg.Send(context.Background(), workFunc(func() bool {
+			atomic.AddInt64(&ran, 1)
+			return true
+		}))
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before ProducerDone")
+	default:
+	}
+	wg.ProducerDone()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return after ProducerDone")
+	}
+	if ran != 10 {
+		t.Fatalf("ran %d jobs, want 10", ran)
+	}
+	if err := wg.Send(context.Background(), workFunc(func() bool { return true })); err != ErrStopped {
+		t.Fatalf("Send after Stop = %v, want ErrStopped", err)
+	}
+}
+
+func TestEnqueueDuringStop(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		wg := NewWorkerGroup(2)
+		wg.Start()
+		var accepted, ran int64
+		start := make(chan bool)
+		done := make(chan bool)
+		for i := 0; i < 8; i++ {
+			go func() {
+				defer func() { done <- true }()
+				<-start
+				for j := 0; j < 50; j++ {
+					ok := wg.Enqueue(workFunc(func() bool {
+						atomic.AddInt64(&ran, 1)
+						return true
+					}))
+					if ok {
+						atomic.AddInt64(&accepted, 1)
+					}
+				}
+			}()
+		}
+		close(start)
+		wg.Stop()
+		for i := 0; i < 8; i++ {
+			<-done
+		}
+		// Whatever Enqueue accepted before Stop closed the group ran.
+		if ran != atomic.LoadInt64(&accepted) {
+			t.Fatalf("round %d: ran %d of %d accepted jobs", round, ran, accepted)
+		}
+	}
+}
+
+func TestWorkerSurvivesPanic(t *testing.T) {
+	wg := NewWorkerGroup(1)
+	wg.Start()
+	if !wg.Enqueue(workFunc(func() bool { panic("boom") })) {
+		t.Fatal("Enqueue refused the panicking job")
+	}
+	ran := make(chan bool)
+	if !wg.Enqueue(workFunc(func() bool {
+		close(ran)
+		return true
+	})) {
+		t.Fatal("Enqueue refused the normal job")
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job after the panic didn't run")
+	}
+	wg.Stop()
+	if processed := wg.Stats().Processed; processed != 2 {
+		t.Fatalf("processed %d jobs, want 2", processed)
+	}
+}
+
+func TestRestartKeepsQueuedJobs(t *testing.T) {
+	wg := NewWorkerGroup(1)
+	wg.Start()
+	block := make(chan bool)
+	wg.Enqueue(workFunc(func() bool {
+		<-block
+		return true
+	}))
+	var ran int64
+	for i := 0; i < 10; i++ {
+		wg.Enqueue(workFunc(func() bool {
+			atomic.AddInt64(&ran, 1)
+			return true
+		}))
+	}
+	restarted := make(chan bool)
+	go func() {
+		wg.Restart()
+		close(restarted)
+	}()
+	// Restart waits for the running job, so the rest is still queued when
+	// the workers are replaced.
+	time.Sleep(50 * time.Millisecond)
+	close(block)
+	select {
+	case <-restarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Restart didn't return")
+	}
+	wg.Stop()
+	if ran != 10 {
+		t.Fatalf("ran %d queued jobs, want 10", ran)
+	}
+}